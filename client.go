@@ -3,39 +3,96 @@ package websocket
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/valyala/bytebufferpool"
 	"github.com/valyala/fasthttp"
 )
 
 var (
 	// ErrCannotUpgrade shows up when an error occurred when upgrading a connection.
+	//
+	// The client returns it wrapped in a HandshakeError holding the server's response.
 	ErrCannotUpgrade = errors.New("cannot upgrade connection")
+	// ErrInvalidAccept is returned when the Sec-WebSocket-Accept header
+	// sent by the server doesn't match the key sent by the client.
+	ErrInvalidAccept = errors.New("invalid Sec-WebSocket-Accept header: the peer is not a websocket server")
+	// ErrProxyScheme is returned when the proxy URL is not an http:// URL.
+	ErrProxyScheme = errors.New("unsupported proxy scheme")
+	// ErrProxyConnect is returned when the proxy refuses the CONNECT request.
+	ErrProxyConnect = errors.New("proxy refused the CONNECT request")
+	// ErrProtocolNotOffered is returned when the server selects a subprotocol
+	// that wasn't offered by the client.
+	ErrProtocolNotOffered = errors.New("the server selected a subprotocol that wasn't offered")
+	// ErrHandshakeTooLarge is returned when the handshake response sent by the server
+	// exceeds the maximum size, see Dialer.MaxHandshakeResponseSize.
+	ErrHandshakeTooLarge = errors.New("handshake response too large")
 )
 
+// HandshakeError is returned by the client when the server
+// doesn't upgrade the connection, i.e. because it rejected the request.
+//
+// It wraps ErrCannotUpgrade, so errors.Is(err, ErrCannotUpgrade) holds.
+type HandshakeError struct {
+	// StatusCode is the status of the server's response.
+	StatusCode int
+	// Body is the body of the server's response, usually the reason of the rejection.
+	Body []byte
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("%s: %d %s", ErrCannotUpgrade, e.StatusCode, fasthttp.StatusMessage(e.StatusCode))
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return ErrCannotUpgrade
+}
+
+// DefaultMaxHandshakeResponseSize is the default maximum size
+// of the headers and of the body of the server's handshake response.
+const DefaultMaxHandshakeResponseSize = 64 << 10
+
 // MakeClient returns Conn using an existing connection.
 //
 // url must be a complete URL format i.e. http://localhost:8080/ws
 func MakeClient(c net.Conn, url string) (*Client, error) {
-	return client(c, url, nil)
+	return client(c, url, nil, nil)
 }
 
 // ClientWithHeaders returns a Conn using an existing connection and sending custom headers.
 func ClientWithHeaders(c net.Conn, url string, req *fasthttp.Request) (*Client, error) {
-	return client(c, url, req)
+	return client(c, url, req, nil)
 }
 
 // UpgradeAsClient will upgrade the connection as a client
 //
 // This function should be used with connections that intend to use a
-// plain framing.
+// plain framing, i.e. obtained through a custom transport.
+// The returned Client reads the frames using the buffer of the handshake,
+// so the frames sent right after the response are not lost.
 //
 // r can be nil.
-func UpgradeAsClient(c net.Conn, url string, r *fasthttp.Request) error {
+func UpgradeAsClient(c net.Conn, url string, r *fasthttp.Request) (*Client, error) {
+	return client(c, url, r, nil)
+}
+
+// upgradeAsClient performs the handshake over brw, so the frames
+// buffered after the response are not lost.
+//
+// The handshake uses the Rand, Subprotocols and Jar of d, and
+// upgradeAsClient returns the protocol selected by the server.
+func upgradeAsClient(brw *bufio.ReadWriter, rawURL string, r *fasthttp.Request, d *Dialer) (string, error) {
 	req := fasthttp.AcquireRequest()
 	res := fasthttp.AcquireResponse()
 	uri := fasthttp.AcquireURI()
@@ -44,7 +101,7 @@ func UpgradeAsClient(c net.Conn, url string, r *fasthttp.Request) error {
 	defer fasthttp.ReleaseResponse(res)
 	defer fasthttp.ReleaseURI(uri)
 
-	uri.Update(url)
+	uri.Update(rawURL)
 
 	origin := bytePool.Get().([]byte)
 	key := bytePool.Get().([]byte)
@@ -52,45 +109,137 @@ func UpgradeAsClient(c net.Conn, url string, r *fasthttp.Request) error {
 	defer bytePool.Put(key)
 
 	origin = prepareOrigin(origin, uri)
-	key = makeRandKey(key[:0])
+
+	key, err := makeRandKey(key[:0], d.randReader())
+	if err != nil {
+		return "", err
+	}
 
 	if r != nil {
 		r.CopyTo(req)
 	}
 
+	jar := d.Jar
+
+	var u *url.URL
+	if jar != nil {
+		u, _ = url.Parse(rawURL)
+	}
+
+	if u != nil {
+		for _, cookie := range jar.Cookies(u) {
+			req.Header.SetCookie(cookie.Name, cookie.Value)
+		}
+	}
+
 	req.Header.SetMethod("GET")
 	req.Header.AddBytesKV(originString, origin)
 	req.Header.AddBytesKV(connectionString, upgradeString)
 	req.Header.AddBytesKV(upgradeString, websocketString)
 	req.Header.AddBytesKV(wsHeaderVersion, supportedVersions[0])
 	req.Header.AddBytesKV(wsHeaderKey, key)
+	if len(d.Subprotocols) != 0 {
+		req.Header.SetBytesK(wsHeaderProtocol, strings.Join(d.Subprotocols, ", "))
+	}
 	// TODO: Add compression
 
 	req.SetRequestURIBytes(uri.FullURI())
 
-	br := bufio.NewReader(c)
-	bw := bufio.NewWriter(c)
-	req.Write(bw)
-	bw.Flush()
+	err = req.Write(brw.Writer)
+	if err == nil {
+		err = brw.Flush()
+	}
+
+	// the body of a rejected upgrade is kept in the HandshakeError
+	if err == nil {
+		err = res.ReadLimitBody(brw.Reader, d.maxHandshakeResponseSize())
+	}
+
+	// the cookies are stored even if the upgrade is rejected
+	if err == nil && u != nil {
+		storeCookies(jar, u, res)
+	}
 
-	err := res.Read(br)
 	if err == nil {
 		if res.StatusCode() != 101 ||
 			!equalsFold(res.Header.PeekBytes(upgradeString), websocketString) {
-			err = ErrCannotUpgrade
+			err = &HandshakeError{
+				StatusCode: res.StatusCode(),
+				Body:       append([]byte(nil), res.Body()...),
+			}
 		}
 	}
 
-	return err
+	if err == nil {
+		accept := bytePool.Get().([]byte)
+		accept = makeKey(accept[:0], key)
+
+		if !bytes.Equal(res.Header.PeekBytes(wsHeaderAccept), accept) {
+			err = ErrInvalidAccept
+		}
+
+		bytePool.Put(accept)
+	}
+
+	var proto string
+	if err == nil {
+		// the server must select one of the offered protocols
+		if b := res.Header.PeekBytes(wsHeaderProtocol); len(b) != 0 {
+			offered := bytes.Split(req.Header.PeekBytes(wsHeaderProtocol), commaString)
+
+			proto = matchProtocol(offered, []string{string(b)})
+			if proto == "" {
+				err = ErrProtocolNotOffered
+			}
+		}
+	}
+
+	return proto, err
 }
 
-func client(c net.Conn, url string, r *fasthttp.Request) (cl *Client, err error) {
-	err = UpgradeAsClient(c, url, r)
+// storeCookies stores into jar the cookies set by res, the response to u.
+func storeCookies(jar http.CookieJar, u *url.URL, res *fasthttp.Response) {
+	var cookies []*http.Cookie
+
+	res.Header.VisitAllCookie(func(key, value []byte) {
+		if cookie, err := http.ParseSetCookie(string(value)); err == nil {
+			cookies = append(cookies, cookie)
+		}
+	})
+
+	if len(cookies) != 0 {
+		jar.SetCookies(u, cookies)
+	}
+}
+
+// client upgrades c using the handshake options of d.
+//
+// d can be nil, then the defaults of Dialer are used.
+func client(c net.Conn, url string, r *fasthttp.Request, d *Dialer) (cl *Client, err error) {
+	if d == nil {
+		d = &Dialer{}
+	}
+
+	// the response headers must fit in the read buffer to be parsed,
+	// so the buffer size limits the headers size.
+	brw := bufio.NewReadWriter(
+		bufio.NewReaderSize(c, d.maxHandshakeResponseSize()), bufio.NewWriter(c))
+
+	proto, err := upgradeAsClient(brw, url, r, d)
+	err = checkResponseSize(err)
+
+	// the frames don't need such a big buffer
+	if err == nil && brw.Reader.Buffered() == 0 && brw.Reader.Size() > defaultBufioSize {
+		brw.Reader = bufio.NewReader(c)
+	}
+
 	if err == nil {
 		cl = &Client{
-			c: c,
-			brw: bufio.NewReadWriter(
-				bufio.NewReader(c), bufio.NewWriter(c)),
+			c:        c,
+			brw:      brw,
+			rand:     d.randReader(),
+			proto:    proto,
+			isClient: true,
 		}
 	}
 
@@ -117,6 +266,9 @@ func DialTLS(url string, cnf *tls.Config) (*Client, error) {
 }
 
 // DialWithHeaders establishes a websocket connection as client sending a personalized request.
+//
+// If the server rejects the request, i.e. because of a missing header,
+// the error is a *HandshakeError holding the status of the response.
 func DialWithHeaders(url string, req *fasthttp.Request) (*Client, error) {
 	cnf := &tls.Config{
 		InsecureSkipVerify: false,
@@ -126,11 +278,154 @@ func DialWithHeaders(url string, req *fasthttp.Request) (*Client, error) {
 	return dial(url, cnf, req)
 }
 
-func dial(url string, cnf *tls.Config, req *fasthttp.Request) (conn *Client, err error) {
+func dial(url string, cnf *tls.Config, req *fasthttp.Request) (*Client, error) {
+	d := &Dialer{
+		TLSConfig: cnf,
+	}
+
+	return d.Dial(url, req)
+}
+
+// Dialer establishes websocket connections as client.
+type Dialer struct {
+	// TLSConfig is used when the URL is wss:// like.
+	//
+	// If TLSConfig.ServerName is empty the host of the URL is used
+	// to verify the certificate and as SNI.
+	TLSConfig *tls.Config
+
+	// Proxy returns the HTTP proxy used to reach the given URL.
+	// The URL passed to Proxy has the http or https scheme
+	// for ws:// and wss:// URLs respectively.
+	//
+	// If Proxy returns a nil URL the connection is established directly.
+	// By default Proxy is ProxyFromEnvironment.
+	Proxy func(*url.URL) (*url.URL, error)
+
+	// Rand is the source used to generate the Sec-WebSocket-Key
+	// and the masking keys of the frames written by Client.
+	//
+	// Masking is not a security feature, so any source can be used,
+	// i.e. a seeded math/rand for deterministic tests. The errors reading
+	// from Rand are returned by Dial and by the writes of the Client.
+	// By default Rand is crypto/rand.Reader.
+	Rand io.Reader
+
+	// Subprotocols are the protocols offered to the server
+	// in the Sec-WebSocket-Protocol header.
+	//
+	// The protocol selected by the server is returned by Client.Protocol.
+	// If the server selects a protocol that wasn't offered, Dial returns ErrProtocolNotOffered.
+	Subprotocols []string
+
+	// RetryCount is the number of times the connection is retried
+	// when the server refuses it, i.e. while the server is starting.
+	//
+	// Any other error, like a rejected upgrade or an invalid TLS certificate,
+	// is returned without retrying.
+	RetryCount int
+
+	// RetryBackoff returns the time to wait before the given retry, starting at 1.
+	//
+	// By default RetryBackoff is DefaultRetryBackoff.
+	RetryBackoff func(attempt int) time.Duration
+
+	// MaxHandshakeResponseSize is the maximum size in bytes of the headers,
+	// and of the body, of the server's handshake response. It also limits
+	// the response of the proxy to the CONNECT request.
+	//
+	// Dial returns ErrHandshakeTooLarge if the server sends a bigger response,
+	// so a misbehaving server can't make the client buffer unbounded data.
+	// By default MaxHandshakeResponseSize is DefaultMaxHandshakeResponseSize.
+	MaxHandshakeResponseSize int
+
+	// Jar manages the cookies of the handshake.
+	//
+	// The cookies of Jar for the URL are sent in the handshake request,
+	// in addition to the ones of the request passed to Dial. The cookies
+	// set by the server's response are stored into Jar, even if the upgrade
+	// is rejected. The URL has the http or https scheme for ws:// and wss://
+	// URLs respectively, like in Proxy. By default no cookie is managed.
+	Jar http.CookieJar
+}
+
+// maxHandshakeResponseSize returns the MaxHandshakeResponseSize or its default.
+func (d *Dialer) maxHandshakeResponseSize() int {
+	if d.MaxHandshakeResponseSize <= 0 {
+		return DefaultMaxHandshakeResponseSize
+	}
+
+	return d.MaxHandshakeResponseSize
+}
+
+// checkResponseSize maps the errors of the responses exceeding
+// the MaxHandshakeResponseSize to ErrHandshakeTooLarge.
+func checkResponseSize(err error) error {
+	var sbErr *fasthttp.ErrSmallBuffer
+	if errors.As(err, &sbErr) || errors.Is(err, fasthttp.ErrBodyTooLarge) {
+		return ErrHandshakeTooLarge
+	}
+
+	return err
+}
+
+// randReader returns the source of the random keys, see Rand.
+func (d *Dialer) randReader() io.Reader {
+	if d.Rand == nil {
+		return rand.Reader
+	}
+
+	return d.Rand
+}
+
+// DefaultRetryBackoff doubles the time waited between the retries,
+// starting at 100 milliseconds and up to 5 seconds.
+func DefaultRetryBackoff(attempt int) time.Duration {
+	d := time.Millisecond * 100
+	for i := 1; i < attempt && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+
+	return d
+}
+
+const maxRetryBackoff = time.Second * 5
+
+// isRefused reports whether err is a connection refused by the server.
+func isRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// ProxyFromEnvironment returns the proxy defined by the HTTP_PROXY, HTTPS_PROXY
+// and NO_PROXY environment variables. See http.ProxyFromEnvironment.
+func ProxyFromEnvironment(u *url.URL) (*url.URL, error) {
+	return http.ProxyFromEnvironment(&http.Request{URL: u})
+}
+
+// Dial establishes a websocket connection as client.
+//
+// If the proxy returned by d.Proxy is not nil, the connection is
+// tunneled through the proxy using an HTTP CONNECT request.
+//
+// rawURL parameter must follow the WebSocket URL format i.e. ws://host:port/path.
+// req can be nil.
+func (d *Dialer) Dial(rawURL string, req *fasthttp.Request) (*Client, error) {
+	return d.DialContext(context.Background(), rawURL, req)
+}
+
+// DialContext is like Dial, but ctx bounds the connection, the handshake
+// and the retries. Once connected, ctx doesn't affect the Client.
+//
+// The connection is retried up to RetryCount times if the server refuses it.
+func (d *Dialer) DialContext(ctx context.Context, rawURL string, req *fasthttp.Request) (conn *Client, err error) {
 	uri := fasthttp.AcquireURI()
 	defer fasthttp.ReleaseURI(uri)
 
-	uri.Update(url)
+	uri.Update(rawURL)
 
 	scheme := "https"
 	port := ":443"
@@ -147,37 +442,251 @@ func dial(url string, cnf *tls.Config, req *fasthttp.Request) (conn *Client, err
 		addr = append(addr, port...)
 	}
 
-	var c net.Conn
+	backoff := d.RetryBackoff
+	if backoff == nil {
+		backoff = DefaultRetryBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		conn, err = d.dial(ctx, scheme, string(addr), uri.String(), req)
+		if err == nil || attempt >= d.RetryCount || !isRefused(err) {
+			return conn, err
+		}
+
+		t := time.NewTimer(backoff(attempt + 1))
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// dial connects to addr and performs the handshake.
+func (d *Dialer) dial(ctx context.Context, scheme, addr, url string, req *fasthttp.Request) (conn *Client, err error) {
+	c, err := d.dialConn(ctx, scheme, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	// cancelling ctx interrupts the handshake
+	stop := context.AfterFunc(ctx, func() {
+		c.SetDeadline(aLongTimeAgo)
+	})
+
+	conn, err = client(c, url, req, d)
+	if !stop() {
+		c.Close()
+		return nil, ctx.Err()
+	}
+
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	c.SetDeadline(time.Time{})
 
-	if scheme == "http" {
-		c, err = net.Dial("tcp", b2s(addr))
+	return conn, nil
+}
+
+func (d *Dialer) dialConn(ctx context.Context, scheme, addr string) (c net.Conn, err error) {
+	proxy := d.Proxy
+	if proxy == nil {
+		proxy = ProxyFromEnvironment
+	}
+
+	proxyURL, err := proxy(&url.URL{Scheme: scheme, Host: addr})
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL == nil {
+		var nd net.Dialer
+		c, err = nd.DialContext(ctx, "tcp", addr)
 	} else {
-		c, err = tls.Dial("tcp", b2s(addr), cnf)
+		c, err = d.dialProxy(ctx, proxyURL, addr)
 	}
 
+	if err != nil || scheme != "https" {
+		return c, err
+	}
+
+	// the TLS handshake happens after the tunnel is established
+	cnf := d.TLSConfig
+	if cnf == nil {
+		cnf = &tls.Config{}
+	}
+
+	if cnf.ServerName == "" {
+		host, _, _ := net.SplitHostPort(addr)
+
+		cnf = cnf.Clone()
+		cnf.ServerName = host
+	}
+
+	tc := tls.Client(c, cnf)
+	if err = tc.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+// dialProxy opens a tunnel to addr through the HTTP proxy.
+func (d *Dialer) dialProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	if proxyURL.Scheme != "http" {
+		return nil, ErrProxyScheme
+	}
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+
+	var nd net.Dialer
+	c, err := nd.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		c.SetDeadline(aLongTimeAgo)
+	})
+
+	bw := bufio.NewWriter(c)
+	fmt.Fprintf(bw, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		fmt.Fprintf(bw, "Proxy-Authorization: Basic %s\r\n",
+			base64.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+
+	bw.WriteString("\r\n")
+
+	err = bw.Flush()
 	if err == nil {
-		conn, err = client(c, uri.String(), req)
-		if err != nil {
-			c.Close()
+		res := fasthttp.AcquireResponse()
+		// the response to CONNECT has no body
+		res.SkipBody = true
+
+		// nothing is sent by the peer before the handshake,
+		// so the reader doesn't buffer any data from the tunnel.
+		br := bufio.NewReaderSize(c, d.maxHandshakeResponseSize())
+
+		err = checkResponseSize(res.ReadLimitBody(br, d.maxHandshakeResponseSize()))
+		if err == nil && res.StatusCode() != fasthttp.StatusOK {
+			err = ErrProxyConnect
 		}
+
+		fasthttp.ReleaseResponse(res)
 	}
-	return conn, err
+
+	if !stop() {
+		c.Close()
+		return nil, ctx.Err()
+	}
+
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
 }
 
-func makeRandKey(b []byte) []byte {
-	b = extendByteSlice(b, 16)
-	rand.Read(b[:16])
-	b = appendEncode(base64, b[:0], b[:16])
-	return b
+func makeRandKey(b []byte, rnd io.Reader) ([]byte, error) {
+	// the random bytes are read after the encoded key,
+	// so the encoding doesn't overwrite them.
+	n := base64.EncodedLen(16)
+	b = extendByteSlice(b, n+16)
+	if _, err := io.ReadFull(rnd, b[n:]); err != nil {
+		return b[:0], err
+	}
+
+	b = appendEncode(base64, b[:0], b[n:])
+	return b, nil
 }
 
 // Client holds a WebSocket connection.
 //
 // The client is NOT concurrently safe. It is intended to be
 // used with the Frame struct.
+//
+// Unlike Conn, the frames are masked before being sent
+// and they must be read by the caller using ReadFrame.
 type Client struct {
-	c   net.Conn
-	brw *bufio.ReadWriter
+	// DisableAutoMask disables the masking of the frames written by WriteFrame.
+	//
+	// The frames sent by a client must be masked, so when DisableAutoMask
+	// is set the frames must be masked by the caller using Frame.Mask.
+	DisableAutoMask bool
+
+	c     net.Conn
+	brw   *bufio.ReadWriter
+	rand  io.Reader
+	proto string
+
+	// isClient is whether c is the client endpoint, set when dialing.
+	isClient bool
+
+	msgHandler   func(isBinary bool, data []byte)
+	pingHandler  func(data []byte)
+	closeHandler func(err error)
+	closed       bool
+}
+
+// OnMessage sets a callback receiving the messages read by Serve,
+// indicating whether the content is binary or not.
+//
+// data is only valid until the callback returns.
+func (c *Client) OnMessage(msgHandler func(isBinary bool, data []byte)) {
+	c.msgHandler = msgHandler
+}
+
+// OnPing sets a callback receiving the data of the ping frames
+// read by ReadFull or Serve. The pings are replied anyway.
+func (c *Client) OnPing(pingHandler func(data []byte)) {
+	c.pingHandler = pingHandler
+}
+
+// OnClose sets a callback fired once when the connection is closed by the peer,
+// as seen by ReadFull.
+//
+// err is nil if the peer closed the connection cleanly (StatusNone).
+// Otherwise err is an Error holding the peer's close status, or
+// StatusAbnormalClosure if the connection was dropped without a close frame,
+// like the errors received by the Server's CloseHandler.
+func (c *Client) OnClose(closeHandler func(err error)) {
+	c.closeHandler = closeHandler
+}
+
+// notifyClose fires the close handler the first time the connection is closed.
+func (c *Client) notifyClose(err error) {
+	if c.closed {
+		return
+	}
+
+	c.closed = true
+
+	if c.closeHandler != nil {
+		c.closeHandler(err)
+	}
+}
+
+// Protocol returns the subprotocol selected by the server.
+//
+// It returns an empty string if the server didn't select any protocol.
+func (c *Client) Protocol() string {
+	return c.proto
 }
 
 // Write writes the content `b` as text.
@@ -190,8 +699,6 @@ func (c *Client) Write(b []byte) (int, error) {
 	fr.SetFin()
 	fr.SetPayload(b)
 	fr.SetText()
-	fr.Mask()
-
 	return c.WriteFrame(fr)
 }
 
@@ -205,13 +712,26 @@ func (c *Client) WriteBinary(b []byte) (int, error) {
 	fr.SetFin()
 	fr.SetPayload(b)
 	fr.SetBinary()
-	fr.Mask()
-
 	return c.WriteFrame(fr)
 }
 
+// IsClient returns whether c is the client endpoint of the connection,
+// which is the case of the clients established by dialing.
+func (c *Client) IsClient() bool {
+	return c.isClient
+}
+
 // WriteFrame writes the frame into the WebSocket connection.
+//
+// The frames sent by a client must be masked, so fr is masked with a fresh key
+// if it isn't already, unless DisableAutoMask is set.
 func (c *Client) WriteFrame(fr *Frame) (int, error) {
+	if !c.DisableAutoMask && !fr.IsMasked() {
+		if err := fr.maskFrom(c.rand); err != nil {
+			return 0, err
+		}
+	}
+
 	nn, err := fr.WriteTo(c.brw)
 	if err == nil {
 		err = c.brw.Flush()
@@ -226,8 +746,188 @@ func (c *Client) ReadFrame(fr *Frame) (int, error) {
 	return int(n), err
 }
 
+// aLongTimeAgo is a deadline in the past, used to unblock the pending reads.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ReadFrameContext reads a frame like ReadFrame, but it returns ctx.Err()
+// once ctx is done, setting a read deadline on the connection.
+//
+// If ctx is done before the frame starts arriving, nothing is consumed
+// and the Client can still be used. If the frame was partially read
+// the stream is out of sync, and the Client must be closed.
+func (c *Client) ReadFrameContext(ctx context.Context, fr *Frame) (n int, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		c.c.SetReadDeadline(deadline)
+	}
+
+	// unblock the read when ctx is cancelled
+	cancelled := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		c.c.SetReadDeadline(aLongTimeAgo)
+		close(cancelled)
+	})
+
+	// Peek doesn't consume the data, so the read can be abandoned
+	// while waiting for the frame.
+	_, err = c.brw.Peek(1)
+	if err == nil {
+		n, err = c.ReadFrame(fr)
+	}
+
+	if !stop() {
+		<-cancelled
+	}
+
+	c.c.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else if hasDeadline && !time.Now().Before(deadline) {
+			// the read deadline might expire before ctx
+			err = context.DeadlineExceeded
+		}
+	}
+
+	return n, err
+}
+
+// ReadFull reads a complete message appending its payload to dst.
+//
+// The continuation frames are read until the final one, reusing fr for every frame.
+// The control frames received in between are answered internally:
+// pings are replied with a pong and a close frame is echoed back.
+//
+// When the peer closes the connection ReadFull returns io.EOF,
+// or an Error if the close frame carries a status other than StatusNone.
+func (c *Client) ReadFull(dst []byte, fr *Frame) ([]byte, error) {
+	_, dst, err := c.readMessage(dst, fr)
+	return dst, err
+}
+
+// readMessage reads a complete message appending its payload to dst,
+// and returns whether the message is binary.
+func (c *Client) readMessage(dst []byte, fr *Frame) (isBinary bool, _ []byte, _ error) {
+	for {
+		fr.Reset()
+
+		if _, err := c.ReadFrame(fr); err != nil {
+			c.notifyClose(abnormalClosure(err))
+			return isBinary, dst, err
+		}
+
+		if fr.IsMasked() {
+			fr.Unmask()
+		}
+
+		if fr.IsControl() {
+			if err := c.handleControl(fr); err != nil {
+				return isBinary, dst, err
+			}
+
+			continue
+		}
+
+		// the continuation frames don't carry the message type
+		if !fr.IsContinuation() {
+			isBinary = fr.IsBinary()
+		}
+
+		dst = append(dst, fr.Payload()...)
+		if fr.IsFin() {
+			return isBinary, dst, nil
+		}
+	}
+}
+
+// Serve reads the messages from the connection and delivers them
+// to the handler set by OnMessage, until the connection is closed.
+//
+// The control frames are handled as in ReadFull. Serve returns nil
+// when the peer closes the connection cleanly.
+func (c *Client) Serve() error {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	bf := bytebufferpool.Get()
+	defer bytebufferpool.Put(bf)
+
+	for {
+		isBinary, b, err := c.readMessage(bf.B[:0], fr)
+		bf.B = b
+
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+
+			return err
+		}
+
+		if c.msgHandler != nil {
+			c.msgHandler(isBinary, b)
+		}
+	}
+}
+
+func (c *Client) handleControl(fr *Frame) error {
+	switch {
+	case fr.IsPing():
+		if c.pingHandler != nil {
+			c.pingHandler(fr.Payload())
+		}
+
+		pong := AcquireFrame()
+		defer ReleaseFrame(pong)
+
+		pong.SetPong()
+		pong.SetFin()
+		pong.SetPayload(fr.Payload())
+
+		_, err := c.WriteFrame(pong)
+
+		return err
+	case fr.IsClose():
+		status := fr.Status()
+		err := error(io.EOF)
+		if status != StatusNone {
+			err = Error{
+				Status: status,
+				Reason: string(fr.Payload()),
+			}
+		}
+
+		if err == io.EOF {
+			c.notifyClose(nil)
+		} else {
+			c.notifyClose(err)
+		}
+
+		reply := AcquireFrame()
+		defer ReleaseFrame(reply)
+
+		reply.SetClose()
+		reply.SetStatus(status)
+		reply.SetFin()
+
+		c.WriteFrame(reply)
+
+		return err
+	}
+
+	return nil
+}
+
 // Close gracefully closes the websocket connection.
 func (c *Client) Close() error {
+	// the connection is closed by the client
+	c.closed = true
+
 	fr := AcquireFrame()
 	fr.SetClose()
 	fr.SetFin()
@@ -1,8 +1,20 @@
 package websocket
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,7 +25,7 @@ import (
 func BenchmarkRandKey(b *testing.B) {
 	var bf []byte
 	for i := 0; i < b.N; i++ {
-		bf = makeRandKey(bf[:0])
+		bf, _ = makeRandKey(bf[:0], rand.Reader)
 	}
 }
 
@@ -76,3 +88,1110 @@ func TestDial(t *testing.T) {
 		t.Fatal("timeout")
 	}
 }
+
+func TestMakeClientBufferedFrame(t *testing.T) {
+	testBufferedFrame(t, func(c net.Conn) (*Client, error) {
+		return MakeClient(c, "http://localhost/")
+	})
+}
+
+func TestUpgradeAsClient(t *testing.T) {
+	testBufferedFrame(t, func(c net.Conn) (*Client, error) {
+		return UpgradeAsClient(c, "http://localhost/", nil)
+	})
+}
+
+// testBufferedFrame checks that the frame sent along with
+// the handshake response is read by the Client returned by upgrade.
+func testBufferedFrame(t *testing.T, upgrade func(c net.Conn) (*Client, error)) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	go func() {
+		defer c2.Close()
+
+		var req fasthttp.Request
+		if err := req.Read(bufio.NewReader(c2)); err != nil {
+			return
+		}
+
+		key := req.Header.PeekBytes(wsHeaderKey)
+
+		// the first frame is sent along with the response,
+		// so it lands in the same buffer
+		var b []byte
+		b = append(b, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: "...)
+		b = append(b, makeKey(nil, key)...)
+		b = append(b, "\r\n\r\n"...)
+		b = append(b, littlePacket...)
+
+		c2.Write(b)
+	}()
+
+	conn, err := upgrade(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(fr.Payload()) != "Hello" {
+		t.Fatalf("Expecting Hello, got %s", fr.Payload())
+	}
+}
+
+func TestDialInvalidAccept(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		var req fasthttp.Request
+		if err := req.Read(bufio.NewReader(c)); err != nil {
+			return
+		}
+
+		fmt.Fprintf(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+			makeKey(nil, []byte("not the key")))
+	}()
+
+	conn, err := Dial("ws://" + ln.Addr().String() + "/")
+	if err != ErrInvalidAccept {
+		if conn != nil {
+			conn.Close()
+		}
+
+		t.Fatalf("Expecting %v, got %v", ErrInvalidAccept, err)
+	}
+}
+
+func TestDialProxy(t *testing.T) {
+	text := []byte("Hello through the proxy")
+
+	wsln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wsln.Close()
+
+	ws := Server{}
+
+	ch := make(chan []byte, 1)
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		ch <- append([]byte(nil), data...)
+	})
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(wsln)
+
+	pln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pln.Close()
+
+	// minimal CONNECT proxy
+	go func() {
+		c, err := pln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		var req fasthttp.Request
+		if err := req.Read(bufio.NewReader(c)); err != nil {
+			return
+		}
+
+		auth := "Basic " + base64.EncodeToString([]byte("user:pass"))
+		if !req.Header.IsConnect() ||
+			string(req.Header.Peek("Proxy-Authorization")) != auth {
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+
+		tc, err := net.Dial("tcp", string(req.Header.Host()))
+		if err != nil {
+			io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		defer tc.Close()
+
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+		go io.Copy(tc, c)
+		io.Copy(c, tc)
+	}()
+
+	d := &Dialer{
+		Proxy: func(u *url.URL) (*url.URL, error) {
+			if u.Host != wsln.Addr().String() {
+				t.Errorf("Unexpected proxy target: %s", u.Host)
+			}
+
+			return url.Parse("http://user:pass@" + pln.Addr().String())
+		},
+	}
+
+	conn, err := d.Dial("ws://"+wsln.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Write(text)
+
+	select {
+	case data := <-ch:
+		if !bytes.Equal(data, text) {
+			t.Fatalf("%s <> %s", data, text)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	conn.Close()
+}
+
+func TestDialerRand(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	src := make([]byte, 20)
+	for i := range src {
+		src[i] = byte(i)
+	}
+
+	type result struct {
+		key  string
+		mask []byte
+		err  error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		var res result
+		defer func() { ch <- res }()
+
+		c, err := ln.Accept()
+		if err != nil {
+			res.err = err
+			return
+		}
+		defer c.Close()
+
+		br := bufio.NewReader(c)
+
+		var req fasthttp.Request
+		if res.err = req.Read(br); res.err != nil {
+			return
+		}
+
+		key := req.Header.PeekBytes(wsHeaderKey)
+		res.key = string(key)
+
+		fmt.Fprintf(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+			makeKey(nil, key))
+
+		fr := AcquireFrame()
+		defer ReleaseFrame(fr)
+
+		if _, res.err = fr.ReadFrom(br); res.err == nil {
+			res.mask = append(res.mask, fr.MaskKey()...)
+		}
+	}()
+
+	d := &Dialer{
+		Proxy: func(*url.URL) (*url.URL, error) { return nil, nil },
+		Rand:  bytes.NewReader(src),
+	}
+
+	conn, err := d.Dial("ws://"+ln.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.c.Close()
+
+	conn.Write([]byte("Hello"))
+
+	res := <-ch
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+
+	if expected := base64.EncodeToString(src[:16]); res.key != expected {
+		t.Fatalf("Expecting key %s, got %s", expected, res.key)
+	}
+
+	if !bytes.Equal(res.mask, src[16:]) {
+		t.Fatalf("Expecting mask key %v, got %v", src[16:], res.mask)
+	}
+
+	// the source is exhausted
+	if _, err := conn.Write([]byte("Hello")); err != io.EOF {
+		t.Fatalf("Expecting io.EOF, got %v", err)
+	}
+
+	if _, err := d.Dial("ws://"+ln.Addr().String()+"/", nil); err != io.EOF {
+		t.Fatalf("Expecting io.EOF, got %v", err)
+	}
+}
+
+func TestClientMasksFrames(t *testing.T) {
+	ws := Server{}
+
+	ch := make(chan string, 1)
+	ws.HandleOpen(func(c *Conn) {
+		if c.IsClient() {
+			t.Error("Expecting server endpoint")
+		}
+	})
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		ch <- string(data)
+	})
+
+	conn := dialServer(t, &ws)
+	if !conn.IsClient() {
+		t.Fatal("Expecting client endpoint")
+	}
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetText()
+	fr.SetFin()
+	fr.SetPayload([]byte("Hello"))
+
+	if _, err := conn.WriteFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsMasked() {
+		t.Fatal("Expecting the frame to be masked")
+	}
+
+	select {
+	case data := <-ch:
+		if data != "Hello" {
+			t.Fatalf("Expecting Hello, got %s", data)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	conn.Close()
+}
+
+func TestClientDisableAutoMask(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	conn := &Client{
+		DisableAutoMask: true,
+		c:               c1,
+		brw:             bufio.NewReadWriter(bufio.NewReader(c1), bufio.NewWriter(c1)),
+		rand:            rand.Reader,
+		isClient:        true,
+	}
+
+	go conn.Write([]byte("Hello"))
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := fr.ReadFrom(c2); err != nil {
+		t.Fatal(err)
+	}
+
+	if fr.IsMasked() || string(fr.Payload()) != "Hello" {
+		t.Fatalf("Expecting an unmasked frame, got %s", fr)
+	}
+}
+
+func TestDialerSubprotocols(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ws := Server{
+		Protocols: []string{"graphql-transport-ws"},
+	}
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	d := &Dialer{
+		Proxy:        func(*url.URL) (*url.URL, error) { return nil, nil },
+		Subprotocols: []string{"graphql-ws", "graphql-transport-ws"},
+	}
+
+	conn, err := d.Dial("ws://"+ln.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if proto := conn.Protocol(); proto != "graphql-transport-ws" {
+		t.Fatalf("Expecting graphql-transport-ws, got %q", proto)
+	}
+
+	conn.Close()
+}
+
+func TestDialerSubprotocolNotOffered(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		var req fasthttp.Request
+		if err := req.Read(bufio.NewReader(c)); err != nil {
+			return
+		}
+
+		fmt.Fprintf(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: %s\r\nSec-WebSocket-Protocol: other\r\n\r\n",
+			makeKey(nil, req.Header.PeekBytes(wsHeaderKey)))
+	}()
+
+	d := &Dialer{
+		Proxy:        func(*url.URL) (*url.URL, error) { return nil, nil },
+		Subprotocols: []string{"chat"},
+	}
+
+	conn, err := d.Dial("ws://"+ln.Addr().String()+"/", nil)
+	if err != ErrProtocolNotOffered {
+		if conn != nil {
+			conn.c.Close()
+		}
+
+		t.Fatalf("Expecting %v, got %v", ErrProtocolNotOffered, err)
+	}
+}
+
+func TestClientReadFull(t *testing.T) {
+	ws := Server{}
+
+	pongs := make(chan string, 1)
+	ws.HandleOpen(func(c *Conn) {
+		fr := AcquireFrame()
+		fr.SetText()
+		fr.SetPayload([]byte("Hello "))
+		c.WriteFrame(fr)
+
+		c.Ping([]byte("ping"))
+
+		fr = AcquireFrame()
+		fr.SetContinuation()
+		fr.SetFin()
+		fr.SetPayload([]byte("world"))
+		c.WriteFrame(fr)
+	})
+	ws.HandlePong(func(c *Conn, data []byte) {
+		pongs <- string(data)
+		c.CloseDetail(StatusGoAway, "bye")
+	})
+
+	conn := dialServer(t, &ws)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	b, err := conn.ReadFull(nil, fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(b); s != "Hello world" {
+		t.Fatalf("Expecting Hello world, got %q", s)
+	}
+
+	select {
+	case data := <-pongs:
+		if data != "ping" {
+			t.Fatalf("Expecting ping, got %q", data)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	_, err = conn.ReadFull(b[:0], fr)
+	if werr, ok := err.(Error); !ok || werr.Status != StatusGoAway {
+		t.Fatalf("Expecting StatusGoAway, got %v", err)
+	}
+
+	conn.c.Close()
+}
+
+func TestClientOnClose(t *testing.T) {
+	ws := Server{}
+
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		c.CloseDetail(StatusGoAway, string(data))
+	})
+
+	conn := dialServer(t, &ws)
+
+	var closeErrs []error
+	conn.OnClose(func(err error) {
+		closeErrs = append(closeErrs, err)
+	})
+
+	io.WriteString(conn, "bye")
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := conn.ReadFull(nil, fr); err == nil {
+		t.Fatal("Expecting the connection to be closed")
+	}
+
+	// the connection is closed by now
+	conn.ReadFull(nil, fr)
+
+	if len(closeErrs) != 1 {
+		t.Fatalf("Expecting the close handler to be called once, got %d", len(closeErrs))
+	}
+
+	if werr, ok := closeErrs[0].(Error); !ok || werr.Status != StatusGoAway || werr.Reason != "bye" {
+		t.Fatalf("Expecting StatusGoAway: bye, got %v", closeErrs[0])
+	}
+
+	conn.c.Close()
+}
+
+func TestClientServe(t *testing.T) {
+	ws := Server{}
+
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		if string(data) == "bye" {
+			c.Close()
+			return
+		}
+
+		c.Ping(data)
+		c.Write(data)
+	})
+
+	conn := dialServer(t, &ws)
+
+	var pings, msgs []string
+	conn.OnPing(func(data []byte) {
+		pings = append(pings, string(data))
+	})
+	conn.OnMessage(func(isBinary bool, data []byte) {
+		if isBinary {
+			t.Errorf("Expecting a text message, got binary %q", data)
+		}
+
+		msgs = append(msgs, string(data))
+		if len(msgs) == 2 {
+			io.WriteString(conn, "bye")
+		}
+	})
+
+	io.WriteString(conn, "hello")
+	io.WriteString(conn, "world")
+
+	if err := conn.Serve(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msgs) != 2 || msgs[0] != "hello" || msgs[1] != "world" {
+		t.Fatalf("Unexpected messages: %q", msgs)
+	}
+
+	if len(pings) != 2 || pings[0] != "hello" || pings[1] != "world" {
+		t.Fatalf("Unexpected pings: %q", pings)
+	}
+
+	conn.c.Close()
+}
+
+// pipeClient returns a Client connected to a connection served by s in memory.
+func pipeClient(s *Server) *Client {
+	c1, c2 := net.Pipe()
+
+	go s.ServeConn(c1, context.Background())
+
+	return &Client{
+		c: c2,
+		brw: bufio.NewReadWriter(
+			bufio.NewReader(c2), bufio.NewWriter(c2)),
+		rand:     rand.Reader,
+		isClient: true,
+	}
+}
+
+func TestPipe(t *testing.T) {
+	client, server := Pipe()
+
+	clientMsgs := client.Messages()
+	serverMsgs := server.Messages()
+
+	for _, tc := range []struct {
+		c    *Conn
+		msgs <-chan Message
+		data string
+	}{
+		{client, serverMsgs, "Hello"},
+		{server, clientMsgs, "World"},
+	} {
+		if _, err := tc.c.Write([]byte(tc.data)); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case m := <-tc.msgs:
+			if string(m.Data) != tc.data {
+				t.Fatalf("Expecting %q, got %q", tc.data, m.Data)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server's end is closed too
+	select {
+	case _, ok := <-serverMsgs:
+		if ok {
+			t.Fatal("Expecting the channel to be closed")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestServerPipe(t *testing.T) {
+	ws := &Server{}
+
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		c.Write(data)
+	})
+
+	closeCh := make(chan error, 1)
+	ws.HandleClose(func(c *Conn, err error) {
+		closeCh <- err
+	})
+
+	client, _ := ws.Pipe()
+
+	msgs := client.Messages()
+
+	client.Write([]byte("Hello"))
+
+	select {
+	case m := <-msgs:
+		if string(m.Data) != "Hello" {
+			t.Fatalf("Expecting Hello, got %q", m.Data)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-closeCh:
+		if err != nil {
+			t.Fatalf("Expecting a clean close, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestPipeMasks(t *testing.T) {
+	ws := &Server{}
+
+	masked := make(chan bool, 8)
+	ws.HandleFrameMeta(func(c *Conn, opcode uint8, length uint64, fin, isMasked bool, rsv uint8) {
+		masked <- isMasked
+	})
+
+	data := make(chan string, 8)
+	ws.HandleData(func(c *Conn, isBinary bool, b []byte) {
+		data <- string(b)
+	})
+
+	client, server := ws.Pipe()
+	defer client.Close()
+
+	if !client.IsClient() || server.IsClient() {
+		t.Fatalf("Expecting a client and a server, got %v and %v", client.IsClient(), server.IsClient())
+	}
+
+	client.Write([]byte("Hello"))
+	client.WriteVectored(false, []byte("Hel"), []byte("lo"))
+	client.WritePrefixed(NewPreparedPrefix(false, []byte("Hel")), []byte("lo"))
+
+	// the prefixed message is made of two frames
+	for i := 0; i < 4; i++ {
+		select {
+		case isMasked := <-masked:
+			if !isMasked {
+				t.Fatalf("frame %d: expecting a masked frame", i)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case b := <-data:
+			if b != "Hello" {
+				t.Fatalf("Expecting Hello, got %q", b)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestDialerRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing listens on addr until the second retry
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ws := Server{}
+
+	reject := false
+	ws.UpgradeHandler = func(ctx *fasthttp.RequestCtx) bool {
+		return !reject
+	}
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+
+	var retries []int
+	d := &Dialer{
+		Proxy: func(*url.URL) (*url.URL, error) {
+			return nil, nil
+		},
+		RetryCount: 5,
+		RetryBackoff: func(attempt int) time.Duration {
+			retries = append(retries, attempt)
+
+			if attempt == 2 {
+				ln, err = net.Listen("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				go s.Serve(ln)
+			}
+
+			return time.Millisecond * 10
+		},
+	}
+
+	conn, err := d.Dial("ws://"+addr+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.c.Close()
+
+	if len(retries) != 2 || retries[0] != 1 || retries[1] != 2 {
+		t.Fatalf("Expecting 2 retries, got %v", retries)
+	}
+
+	// the rejected upgrade is not retried
+	reject = true
+	retries = retries[:0]
+
+	if _, err := d.Dial("ws://"+addr+"/", nil); !errors.Is(err, ErrCannotUpgrade) {
+		t.Fatalf("Expecting ErrCannotUpgrade, got %v", err)
+	}
+
+	if len(retries) != 0 {
+		t.Fatalf("Expecting no retries, got %v", retries)
+	}
+
+	ln.Close()
+
+	// the retries stop when the context expires
+	d.RetryCount = 1000
+	d.RetryBackoff = func(int) time.Duration {
+		return time.Millisecond * 10
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	if _, err := d.DialContext(ctx, "ws://"+addr+"/", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expecting %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestDialContextCancel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the server accepts the connection but never replies
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		io.Copy(io.Discard, c)
+	}()
+
+	d := &Dialer{
+		Proxy: func(*url.URL) (*url.URL, error) {
+			return nil, nil
+		},
+	}
+
+	// ctx has no deadline
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*50, cancel)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := d.DialContext(ctx, "ws://"+ln.Addr().String()+"/", nil)
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("Expecting %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestDefaultRetryBackoff(t *testing.T) {
+	for attempt, expect := range []time.Duration{
+		1:  time.Millisecond * 100,
+		2:  time.Millisecond * 200,
+		3:  time.Millisecond * 400,
+		6:  time.Millisecond * 3200,
+		7:  time.Second * 5,
+		50: time.Second * 5,
+	} {
+		if expect == 0 {
+			continue
+		}
+
+		if d := DefaultRetryBackoff(attempt); d != expect {
+			t.Fatalf("attempt %d: expecting %s, got %s", attempt, expect, d)
+		}
+	}
+}
+
+func TestClientReadFrameContext(t *testing.T) {
+	ws := &Server{}
+
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		c.Write(data)
+	})
+
+	conn := pipeClient(ws)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	if _, err := conn.ReadFrameContext(ctx, fr); err != context.DeadlineExceeded {
+		t.Fatalf("Expecting %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*50, cancel)
+
+	if _, err := conn.ReadFrameContext(ctx, fr); err != context.Canceled {
+		t.Fatalf("Expecting %v, got %v", context.Canceled, err)
+	}
+
+	// the connection is still usable
+	io.WriteString(conn, "Hello")
+
+	fr.Reset()
+	if _, err := conn.ReadFrameContext(context.Background(), fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(fr.Payload()); s != "Hello" {
+		t.Fatalf("Expecting Hello, got %q", s)
+	}
+
+	conn.Close()
+}
+
+func TestDialerMaxHandshakeResponseSize(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ws := Server{}
+	ws.UpgradeHandler = func(ctx *fasthttp.RequestCtx) bool {
+		if string(ctx.Path()) == "/reject" {
+			ctx.Error(strings.Repeat("a", 8192), fasthttp.StatusForbidden)
+			return false
+		}
+
+		ctx.Response.Header.Set("X-Padding", strings.Repeat("a", 8192))
+		return true
+	}
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	d := &Dialer{
+		Proxy: func(*url.URL) (*url.URL, error) {
+			return nil, nil
+		},
+		MaxHandshakeResponseSize: 4096,
+	}
+
+	addr := "ws://" + ln.Addr().String() + "/"
+
+	if _, err := d.Dial(addr, nil); err != ErrHandshakeTooLarge {
+		t.Fatalf("Expecting ErrHandshakeTooLarge, got %v", err)
+	}
+
+	// the body of a rejected upgrade is limited too
+	if _, err := d.Dial(addr+"reject", nil); err != ErrHandshakeTooLarge {
+		t.Fatalf("Expecting ErrHandshakeTooLarge, got %v", err)
+	}
+
+	// the default size fits the response
+	d.MaxHandshakeResponseSize = 0
+
+	conn, err := d.Dial(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := conn.brw.Reader.Size(); n != defaultBufioSize {
+		t.Fatalf("Expecting a read buffer of %d bytes, got %d", defaultBufioSize, n)
+	}
+
+	conn.c.Close()
+}
+
+func TestHandshakeError(t *testing.T) {
+	ws := Server{
+		UpgradeHandler: func(ctx *fasthttp.RequestCtx) bool {
+			if string(ctx.Request.Header.Peek("X-Key")) == "" {
+				ctx.Error("missing key", fasthttp.StatusUnauthorized)
+			}
+
+			return false
+		},
+	}
+
+	ln := serveInmemory(t, &ws)
+
+	for _, tc := range []struct {
+		key    string
+		status int
+		body   string
+	}{
+		{"", fasthttp.StatusUnauthorized, "missing key"},
+		{"wrong", fasthttp.StatusForbidden, ""},
+	} {
+		c, err := ln.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := fasthttp.AcquireRequest()
+		if tc.key != "" {
+			req.Header.Set("X-Key", tc.key)
+		}
+
+		_, err = ClientWithHeaders(c, "http://localhost/", req)
+		fasthttp.ReleaseRequest(req)
+		c.Close()
+
+		var hsErr *HandshakeError
+		if !errors.As(err, &hsErr) || !errors.Is(err, ErrCannotUpgrade) {
+			t.Fatalf("Expecting a HandshakeError, got %v", err)
+		}
+
+		if hsErr.StatusCode != tc.status || string(hsErr.Body) != tc.body {
+			t.Fatalf("Expecting %d %q, got %d %q", tc.status, tc.body, hsErr.StatusCode, hsErr.Body)
+		}
+	}
+}
+
+func TestDialerJar(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ws := Server{
+		UpgradeHandler: func(ctx *fasthttp.RequestCtx) bool {
+			c := fasthttp.AcquireCookie()
+			defer fasthttp.ReleaseCookie(c)
+
+			c.SetKey("seen")
+			c.SetValue(string(ctx.Request.Header.Cookie("session")))
+			ctx.Response.Header.SetCookie(c)
+
+			return true
+		},
+	}
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(ln)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &url.URL{Scheme: "http", Host: ln.Addr().String(), Path: "/"}
+	jar.SetCookies(u, []*http.Cookie{{Name: "session", Value: "42"}})
+
+	d := &Dialer{
+		Proxy: func(*url.URL) (*url.URL, error) {
+			return nil, nil
+		},
+		Jar: jar,
+	}
+
+	conn, err := d.Dial("ws://"+ln.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	cookies := make(map[string]string)
+	for _, c := range jar.Cookies(u) {
+		cookies[c.Name] = c.Value
+	}
+
+	if cookies["session"] != "42" || cookies["seen"] != "42" {
+		t.Fatalf("Unexpected cookies %v", cookies)
+	}
+}
+
+func TestDialerServerName(t *testing.T) {
+	cert := makeTestCert(t, "ws.example.com")
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	names := make(chan string, 2)
+	tln := tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			names <- hello.ServerName
+			return nil, nil
+		},
+	})
+
+	ws := Server{}
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+	go s.Serve(tln)
+
+	cnf := &tls.Config{
+		RootCAs:    roots,
+		ServerName: "ws.example.com",
+	}
+
+	d := &Dialer{
+		TLSConfig: cnf,
+		Proxy: func(*url.URL) (*url.URL, error) {
+			return nil, nil
+		},
+	}
+
+	addr := "wss://" + ln.Addr().String() + "/"
+
+	// the certificate is verified against the ServerName, not the IP
+	conn, err := d.Dial(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if name := <-names; name != "ws.example.com" {
+		t.Fatalf("Expecting SNI ws.example.com, got %q", name)
+	}
+
+	// by default the URL host is verified
+	cnf.ServerName = ""
+
+	var hostErr x509.HostnameError
+	if _, err := d.Dial(addr, nil); !errors.As(err, &hostErr) {
+		t.Fatalf("Expecting a hostname error, got %v", err)
+	}
+
+	if cnf.ServerName != "" {
+		t.Fatalf("Expecting the TLSConfig not to be modified, got %q", cnf.ServerName)
+	}
+}
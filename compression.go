@@ -0,0 +1,290 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/valyala/bytebufferpool"
+)
+
+var (
+	// ErrCompressionLevel is returned when the compression level is not a valid flate level.
+	ErrCompressionLevel = errors.New("invalid compression level")
+)
+
+// DefaultCompressionThreshold is the default value of Conn.CompressionThreshold.
+const DefaultCompressionThreshold = 256
+
+// deflateTail is removed from the compressed messages
+// and appended back before decompressing them.
+//
+// https://tools.ietf.org/html/rfc7692#section-7.2.1
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// deflateFinalBlock is an empty final block appended after the deflateTail,
+// so a complete message ends with io.EOF and a truncated one fails.
+var deflateFinalBlock = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+// flateWriterPools holds one pool per compression level,
+// from flate.HuffmanOnly to flate.BestCompression.
+//
+// The context takeover is disabled, so the flate state is only needed while
+// a message is being compressed or decompressed. The writers and readers are
+// reset for every message and shared by all the connections through the pools,
+// instead of pinning a sliding window per connection.
+var flateWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+var flateReaderPool sync.Pool
+
+// emptyFlateSource replaces the source of the pooled flate readers,
+// so they don't keep the last message alive.
+var emptyFlateSource = bytes.NewReader(nil)
+
+func isValidCompressionLevel(level int) bool {
+	return level >= flate.HuffmanOnly && level <= flate.BestCompression
+}
+
+// negotiateDeflate reports whether permessage-deflate is in the extensions
+// offered by the client with parameters the server can accept.
+//
+// The server always disables the context takeover, so the offers asking
+// the server to use a smaller LZ77 window are declined. maxWindowBits is
+// whether the offer accepted limits the window to 15 bits, the default,
+// which the response must acknowledge.
+func negotiateDeflate(exts []byte) (accept, maxWindowBits bool) {
+	for _, ext := range bytes.Split(exts, commaString) {
+		params := bytes.Split(ext, []byte(";"))
+		if !equalsFold(bytes.TrimSpace(params[0]), permessageDeflate) {
+			continue
+		}
+
+		accept, maxWindowBits = true, false
+		for _, param := range params[1:] {
+			param = bytes.TrimSpace(param)
+			if !bytes.HasPrefix(param, serverMaxWindowBits) {
+				continue
+			}
+
+			if !bytes.Equal(param[len(serverMaxWindowBits):], []byte("=15")) {
+				accept = false
+				break
+			}
+
+			maxWindowBits = true
+		}
+
+		if accept {
+			return true, maxWindowBits
+		}
+	}
+
+	return false, false
+}
+
+// negotiateLegacyDeflate reports whether the legacy x-webkit-deflate-frame
+// extension is in the extensions offered by the client.
+func negotiateLegacyDeflate(exts []byte) bool {
+	for _, ext := range bytes.Split(exts, commaString) {
+		params := bytes.Split(ext, []byte(";"))
+		if equalsFold(bytes.TrimSpace(params[0]), webkitDeflateFrame) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// appendLegacyDeflateResponse appends the x-webkit-deflate-frame response
+// to the Sec-WebSocket-Extensions header value.
+//
+// Like for permessage-deflate, the server doesn't use the context takeover.
+func appendLegacyDeflateResponse(b []byte) []byte {
+	b = append(b, webkitDeflateFrame...)
+	b = append(b, "; "...)
+	return append(b, noCtxTakeover...)
+}
+
+// appendDeflateResponse appends the permessage-deflate response
+// to the Sec-WebSocket-Extensions header value.
+//
+// maxWindowBits is whether the client offered server_max_window_bits,
+// so the parameter is included in the response (RFC 7692, section 7.1.2.1).
+func appendDeflateResponse(b []byte, maxWindowBits bool) []byte {
+	b = append(b, permessageDeflate...)
+	b = append(b, "; "...)
+	b = append(b, serverNoCtxTakeover...)
+	b = append(b, "; "...)
+	b = append(b, clientNoCtxTakeover...)
+
+	if maxWindowBits {
+		b = append(b, "; "...)
+		b = append(b, serverMaxWindowBits...)
+		b = append(b, "=15"...)
+	}
+
+	return b
+}
+
+// compressPayload writes b compressed into bf.
+func compressPayload(bf *bytebufferpool.ByteBuffer, b []byte, level int) error {
+	pool := &flateWriterPools[level-flate.HuffmanOnly]
+
+	fw, _ := pool.Get().(*flate.Writer)
+	if fw == nil {
+		fw, _ = flate.NewWriter(bf, level)
+	} else {
+		fw.Reset(bf)
+	}
+	defer pool.Put(fw)
+
+	_, err := fw.Write(b)
+	if err == nil {
+		err = fw.Flush()
+	}
+
+	if err == nil {
+		bf.B = bytes.TrimSuffix(bf.B, deflateTail)
+	}
+
+	return err
+}
+
+// decompressPayload writes b decompressed into bf.
+//
+// If max is greater than 0 and the decompressed payload is
+// bigger than max, errLenTooBig is returned.
+func decompressPayload(bf *bytebufferpool.ByteBuffer, b []byte, max uint64) error {
+	r := newDeflateReader(bytes.NewReader(b), nil)
+	defer r.Close()
+
+	var rd io.Reader = r
+	if max > 0 {
+		rd = io.LimitReader(r, int64(max)+1)
+	}
+
+	_, err := bf.ReadFrom(rd)
+	if err == nil && max > 0 && uint64(len(bf.B)) > max {
+		err = errLenTooBig
+	}
+
+	return err
+}
+
+// deflateReader decompresses a message read from r.
+type deflateReader struct {
+	fr io.ReadCloser
+}
+
+// newDeflateReader returns a deflateReader decompressing r
+// using dict as the preset dictionary, if not nil.
+func newDeflateReader(r io.Reader, dict []byte) *deflateReader {
+	r = io.MultiReader(r, bytes.NewReader(deflateTail), bytes.NewReader(deflateFinalBlock))
+
+	fr, _ := flateReaderPool.Get().(io.ReadCloser)
+	if fr == nil {
+		fr = flate.NewReaderDict(r, dict)
+	} else {
+		fr.(flate.Resetter).Reset(r, dict)
+	}
+
+	return &deflateReader{
+		fr: fr,
+	}
+}
+
+func (dr *deflateReader) Read(b []byte) (int, error) {
+	return dr.fr.Read(b)
+}
+
+// Close puts back the flate reader into the pool.
+func (dr *deflateReader) Close() error {
+	if dr.fr != nil {
+		dr.fr.(flate.Resetter).Reset(emptyFlateSource, nil)
+		flateReaderPool.Put(dr.fr)
+		dr.fr = nil
+	}
+
+	return nil
+}
+
+// inflateWindowSize is the size of the LZ77 window
+// of the frames compressed using x-webkit-deflate-frame.
+const inflateWindowSize = 1 << 15
+
+// inflateFrame decompresses the payload of fr compressed
+// using x-webkit-deflate-frame, unsetting RSV1.
+//
+// Unlike permessage-deflate, every frame is compressed on its own, including
+// the continuation frames, and the client might use the context takeover.
+// So the last decompressed bytes are kept as the dictionary of the next frame.
+func (c *Conn) inflateFrame(fr *Frame) error {
+	bf := bytebufferpool.Get()
+	defer bytebufferpool.Put(bf)
+
+	bf.Reset()
+
+	r := newDeflateReader(bytes.NewReader(fr.Payload()), c.inflateWindow)
+	defer r.Close()
+
+	var rd io.Reader = r
+	if max := c.maxPayloadSize(); max > 0 {
+		rd = io.LimitReader(r, int64(max)+1)
+	}
+
+	if _, err := bf.ReadFrom(rd); err != nil {
+		return err
+	}
+
+	if max := c.maxPayloadSize(); max > 0 && uint64(len(bf.B)) > max {
+		return errLenTooBig
+	}
+
+	c.inflateWindow = append(c.inflateWindow, bf.B...)
+	if n := len(c.inflateWindow) - inflateWindowSize; n > 0 {
+		c.inflateWindow = append(c.inflateWindow[:0], c.inflateWindow[n:]...)
+	}
+
+	fr.SetPayload(bf.B)
+	fr.op[0] &^= rsv1Bit
+
+	return nil
+}
+
+// mustCompress reports whether fr must be compressed before writing it.
+//
+// Only the messages sent in a single frame are compressed,
+// and the ones smaller than CompressionThreshold are sent uncompressed.
+func (c *Conn) mustCompress(fr *Frame) bool {
+	n := len(fr.Payload())
+
+	return c.compress && atomic.LoadInt32(&c.noWriteCompression) == 0 &&
+		fr.IsFin() && (fr.IsText() || fr.IsBinary()) &&
+		!fr.HasRSV1() && n != 0 && n >= c.CompressionThreshold
+}
+
+// compressFrame replaces the payload of fr with the compressed one if needed.
+//
+// The frames are compressed when they are queued, so EnableWriteCompression
+// and SetCompressionLevel don't affect the frames queued before.
+// If the payload can't be compressed or the compressed payload
+// isn't smaller, the frame is sent uncompressed.
+func (c *Conn) compressFrame(fr *Frame) {
+	if !c.mustCompress(fr) {
+		return
+	}
+
+	bf := bytebufferpool.Get()
+	defer bytebufferpool.Put(bf)
+
+	bf.Reset()
+
+	err := compressPayload(bf, fr.Payload(), int(atomic.LoadInt32(&c.compressionLevel)))
+	if err == nil && len(bf.B) < len(fr.Payload()) {
+		fr.SetPayload(bf.B)
+		fr.SetRSV1()
+	}
+}
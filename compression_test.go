@@ -0,0 +1,404 @@
+package websocket
+
+import (
+	"compress/flate"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/bytebufferpool"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func openDeflateConn(t *testing.T, ln *fasthttputil.InmemoryListener) *Client {
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetBytesKV(wsHeaderExtensions, []byte("permessage-deflate; client_max_window_bits"))
+
+	conn, err := ClientWithHeaders(c, "http://localhost/", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func TestNegotiateDeflate(t *testing.T) {
+	for _, tc := range []struct {
+		exts          string
+		expect        bool
+		maxWindowBits bool
+	}{
+		{"", false, false},
+		{"x-webkit-deflate-frame", false, false},
+		{"permessage-deflate", true, false},
+		{"permessage-deflate; client_max_window_bits", true, false},
+		{"permessage-deflate; server_max_window_bits=10", false, false},
+		{"permessage-deflate; server_max_window_bits=15", true, true},
+		{"permessage-deflate; server_max_window_bits=10, permessage-deflate", true, false},
+		{"permessage-deflate; server_max_window_bits=15, permessage-deflate", true, true},
+	} {
+		got, maxWindowBits := negotiateDeflate([]byte(tc.exts))
+		if got != tc.expect || maxWindowBits != tc.maxWindowBits {
+			t.Errorf("%q: expecting %v %v, got %v %v", tc.exts, tc.expect, tc.maxWindowBits, got, maxWindowBits)
+		}
+	}
+
+	// the server_max_window_bits offered is acknowledged
+	if b := string(appendDeflateResponse(nil, true)); !strings.HasSuffix(b, "; server_max_window_bits=15") {
+		t.Errorf("Expecting server_max_window_bits=15 in %q", b)
+	}
+}
+
+func TestCompressPayload(t *testing.T) {
+	data := []byte("Hello Hello Hello Hello Hello")
+
+	for level := flate.HuffmanOnly; level <= flate.BestCompression; level++ {
+		bf := bytebufferpool.Get()
+		if err := compressPayload(bf, data, level); err != nil {
+			t.Fatal(err)
+		}
+
+		out := bytebufferpool.Get()
+		if err := decompressPayload(out, bf.B, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(out.B) != string(data) {
+			t.Fatalf("level %d: expecting %q, got %q", level, data, out.B)
+		}
+
+		if err := decompressPayload(out, bf.B, 4); err != errLenTooBig {
+			t.Fatalf("Expecting errLenTooBig, got %v", err)
+		}
+
+		// a truncated payload isn't accepted
+		out.Reset()
+		if err := decompressPayload(out, bf.B[:len(bf.B)/2], 0); err == nil {
+			t.Fatalf("level %d: expecting an error decompressing a truncated payload, got %q", level, out.B)
+		}
+
+		bytebufferpool.Put(bf)
+		bytebufferpool.Put(out)
+	}
+}
+
+func TestConnCompression(t *testing.T) {
+	ws := Server{
+		EnableCompression: true,
+	}
+
+	ch := make(chan string, 1)
+	ws.HandleOpen(func(c *Conn) {
+		if err := c.SetCompressionLevel(flate.BestCompression + 1); err != ErrCompressionLevel {
+			t.Errorf("Expecting ErrCompressionLevel, got %v", err)
+		}
+
+		if err := c.SetCompressionLevel(flate.BestSpeed); err != nil {
+			t.Error(err)
+		}
+
+		c.CompressionThreshold = 0
+
+		c.Write([]byte(strings.Repeat("compressed ", 16)))
+
+		c.EnableWriteCompression(false)
+		c.Write([]byte("plain"))
+	})
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		ch <- string(data)
+	})
+
+	ln := serveInmemory(t, &ws)
+
+	conn := openDeflateConn(t, ln)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.HasRSV1() {
+		t.Fatal("Expecting a compressed frame")
+	}
+
+	bf := bytebufferpool.Get()
+	defer bytebufferpool.Put(bf)
+
+	if err := decompressPayload(bf, fr.Payload(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(bf.B); s != strings.Repeat("compressed ", 16) {
+		t.Fatalf("Unexpected message: %q", s)
+	}
+
+	fr.Reset()
+
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if fr.HasRSV1() {
+		t.Fatal("Expecting an uncompressed frame")
+	}
+
+	if s := string(fr.Payload()); s != "plain" {
+		t.Fatalf("Unexpected message: %q", s)
+	}
+
+	bf.Reset()
+	if err := compressPayload(bf, []byte("Hello"), flate.DefaultCompression); err != nil {
+		t.Fatal(err)
+	}
+
+	fr.Reset()
+	fr.SetText()
+	fr.SetFin()
+	fr.SetRSV1()
+	fr.SetPayload(bf.B)
+
+	if _, err := conn.WriteFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-ch:
+		if data != "Hello" {
+			t.Fatalf("Expecting Hello, got %q", data)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	conn.Close()
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	c := &Conn{
+		compress:             true,
+		CompressionThreshold: DefaultCompressionThreshold,
+	}
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetText()
+	fr.SetFin()
+	fr.SetPayload(make([]byte, DefaultCompressionThreshold-1))
+
+	if c.mustCompress(fr) {
+		t.Fatal("Expecting the frame below the threshold to be sent uncompressed")
+	}
+
+	fr.SetPayload(make([]byte, DefaultCompressionThreshold))
+
+	if !c.mustCompress(fr) {
+		t.Fatal("Expecting the frame to be compressed")
+	}
+
+	c.CompressionThreshold = 0
+	fr.SetPayload([]byte("a"))
+
+	if !c.mustCompress(fr) {
+		t.Fatal("Expecting the frame to be compressed when the threshold is disabled")
+	}
+}
+
+func TestDeflateNoContextTakeover(t *testing.T) {
+	c := &Conn{
+		compress:         true,
+		compressionLevel: flate.DefaultCompression,
+	}
+
+	data := []byte(strings.Repeat("no context takeover ", 8))
+
+	var payloads [][]byte
+	for i := 0; i < 2; i++ {
+		fr := AcquireFrame()
+		fr.SetBinary()
+		fr.SetFin()
+		fr.SetPayload(data)
+
+		c.compressFrame(fr)
+		if !fr.HasRSV1() {
+			t.Fatal("Expecting a compressed frame")
+		}
+
+		payloads = append(payloads, append([]byte(nil), fr.Payload()...))
+
+		ReleaseFrame(fr)
+	}
+
+	// the same message must be compressed the same way,
+	// since no state is kept between the messages.
+	if string(payloads[0]) != string(payloads[1]) {
+		t.Fatalf("Expecting equal payloads, got %x and %x", payloads[0], payloads[1])
+	}
+
+	// and every message must be decompressed alone.
+	for i := len(payloads) - 1; i >= 0; i-- {
+		bf := bytebufferpool.Get()
+		if err := decompressPayload(bf, payloads[i], 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(bf.B) != string(data) {
+			t.Fatalf("Expecting %q, got %q", data, bf.B)
+		}
+
+		bytebufferpool.Put(bf)
+	}
+}
+
+func TestCompressionBailout(t *testing.T) {
+	c := &Conn{
+		compress:         true,
+		compressionLevel: flate.BestCompression,
+	}
+
+	data := make([]byte, 1024)
+	rand.New(rand.NewSource(0)).Read(data)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetBinary()
+	fr.SetFin()
+	fr.SetPayload(data)
+
+	c.compressFrame(fr)
+
+	if fr.HasRSV1() {
+		t.Fatal("Expecting the incompressible frame to be sent uncompressed")
+	}
+
+	if string(fr.Payload()) != string(data) {
+		t.Fatal("Expecting the original payload")
+	}
+}
+
+func TestLegacyDeflate(t *testing.T) {
+	peek := func(exts string) func(key []byte) []byte {
+		return func(key []byte) []byte {
+			switch string(key) {
+			case string(wsHeaderVersion):
+				return []byte("13")
+			case string(wsHeaderExtensions):
+				return []byte(exts)
+			}
+
+			return nil
+		}
+	}
+
+	for _, tc := range []struct {
+		exts       string
+		compress   bool
+		legacy     bool
+		extensions string
+	}{
+		{"", false, false, ""},
+		{"x-webkit-deflate-frame", true, true, "x-webkit-deflate-frame; no_context_takeover"},
+		{"x-webkit-deflate-frame, permessage-deflate", true, false, string(appendDeflateResponse(nil, false))},
+	} {
+		s := &Server{
+			EnableCompression:   true,
+			EnableLegacyDeflate: true,
+		}
+
+		hs, _, _ := s.negotiate(peek(tc.exts))
+		if hs.compress != tc.compress || hs.legacyDeflate != tc.legacy {
+			t.Fatalf("%q: expecting %v %v, got %v %v", tc.exts, tc.compress, tc.legacy, hs.compress, hs.legacyDeflate)
+		}
+
+		if hs.compress {
+			if ext := string(hs.appendExtensions(nil)); ext != tc.extensions {
+				t.Fatalf("%q: expecting %q, got %q", tc.exts, tc.extensions, ext)
+			}
+		}
+	}
+
+	// the legacy extension must be enabled
+	s := &Server{
+		EnableCompression: true,
+	}
+
+	if hs, _, _ := s.negotiate(peek("x-webkit-deflate-frame")); hs.compress {
+		t.Fatal("Expecting no compression")
+	}
+
+	ws := Server{
+		EnableLegacyDeflate: true,
+	}
+
+	ch := make(chan string, 1)
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		ch <- string(data)
+	})
+
+	ln := serveInmemory(t, &ws)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetBytesKV(wsHeaderExtensions, webkitDeflateFrame)
+
+	conn, err := ClientWithHeaders(c, "http://localhost/", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the client compresses every frame using the context takeover,
+	// so the second frame refers to the first one.
+	var out bytebufferpool.ByteBuffer
+	fw, _ := flate.NewWriter(&out, flate.BestCompression)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	for i, data := range []string{"Hello Hello ", "Hello World"} {
+		out.Reset()
+		fw.Write([]byte(data))
+		fw.Flush()
+
+		fr.Reset()
+		if i == 0 {
+			fr.SetText()
+		} else {
+			fr.SetContinuation()
+			fr.SetFin()
+		}
+		fr.SetRSV1()
+		fr.SetPayload(out.B[:len(out.B)-len(deflateTail)])
+
+		if _, err := conn.WriteFrame(fr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case data := <-ch:
+		if data != "Hello Hello Hello World" {
+			t.Fatalf("Expecting %q, got %q", "Hello Hello Hello World", data)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
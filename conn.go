@@ -2,19 +2,62 @@ package websocket
 
 import (
 	"bufio"
+	"compress/flate"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"io"
 	"net"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/valyala/bytebufferpool"
 )
 
+var (
+	// ErrConnClosed is returned when writing into a closed connection.
+	ErrConnClosed = errors.New("connection is closed")
+	// ErrNotControl is returned by WriteControl when the frame is not a control frame.
+	ErrNotControl = errors.New("frame is not a control frame")
+	// ErrIdleTimeout is reported when the connection exceeded the Server.IdleTimeout.
+	ErrIdleTimeout = errors.New("idle timeout")
+	// ErrCloseTimeout is returned by CloseWithTimeout when the connection
+	// had to be closed before the close frame was written.
+	ErrCloseTimeout = errors.New("close timeout")
+)
+
 // Conn represents a WebSocket connection on the server side.
 //
-// This handler is compatible with io.Writer.
+// Conn implements io.Writer, io.ReaderFrom and io.WriterTo.
+//
+// The frames are read by the Server and delivered to its handlers.
+// For the client side of the connection see Client.
+//
+// Conn is safe for concurrent writers. The frames of a single message
+// are always written together, so the data frames of different messages never interleave.
+//
+// Once the CloseHandler returns the buffers of the connection are released,
+// so the writes into c return ErrConnClosed.
 type Conn struct {
+	// bytesRead, bytesWritten, lastActive, pendingRead and MaxPayloadSize
+	// are accessed atomically, they are kept first so they are 64-bit aligned.
+	bytesRead    uint64
+	bytesWritten uint64
+	// lastActive is the time in UnixNano when the last frame was read or written.
+	lastActive int64
+	// pendingRead is the size of the fragmented message being buffered.
+	pendingRead int64
+
+	// MaxPayloadSize prevents huge memory allocation.
+	//
+	// By default MaxPayloadSize is DefaultPayloadSize.
+	// Use SetMaxPayloadSize to change it once the connection is being served.
+	MaxPayloadSize uint64
+
 	c  net.Conn
 	br *bufio.Reader
 	bw *bufio.Writer
@@ -22,26 +65,124 @@ type Conn struct {
 	input  chan *Frame
 	output chan *Frame
 
+	// wmu serializes the frames queued into output.
+	wmu sync.Mutex
+
+	// bwmu serializes the frames written into bw.
+	bwmu sync.Mutex
+	// cw counts the bytes of the current frame written into c.
+	cw countWriter
+
+	// flushers is used to wait until all the queued frames are written.
+	flushers chan chan error
+
 	closer    chan struct{}
 	closeOnce sync.Once
 
+	// writeDone is closed when the write loop exits.
+	writeDone chan struct{}
+
+	// closeReceived is closed when the peer's close frame is received.
+	closeReceived chan struct{}
+	// closeSent is set atomically when a close frame waiting for
+	// the acknowledgment was sent, so the peer's reply isn't echoed.
+	closeSent int32
+
+	// readBlocked is set atomically while the read loop waits
+	// for the handlers to consume the frames read.
+	readBlocked int32
+
+	// inlineReads is whether the frames are read by the server's
+	// goroutine instead of the read loop, see Server.ReadBufferFrames.
+	inlineReads bool
+	// unblock closes the connection read inline if the read deadline
+	// set once c is closed didn't interrupt the read in progress.
+	unblock *time.Timer
+
+	// readAhead is the payload size of the frames waiting for the handlers,
+	// limited to readAheadMax (see Server.ReadBufferBytes). drained is
+	// signaled when readAhead goes below the limit.
+	readAhead    int64
+	readAheadMax int64
+	drained      chan struct{}
+
 	errch chan error
 
 	// buffered messages
 	buffered *bytebufferpool.ByteBuffer
+	// bufferedBinary is whether the buffered message is binary.
+	bufferedBinary bool
+	// bufferedCompressed is whether the buffered message is compressed.
+	bufferedCompressed bool
+
+	// reader streams the fragmented message to the MessageReaderHandler.
+	reader *messageReader
+
+	// streamMu protects stream, messages and messagesClosed.
+	streamMu sync.Mutex
+	// stream receives the next incoming message, see MessageStream and WriteTo.
+	stream *streamReader
+	// readingStream is the stream the current message is delivered to.
+	readingStream *streamReader
+	// messages is the channel returned by Messages.
+	messages chan Message
+	// messagesClosed is whether the connection closed messages.
+	messagesClosed bool
+	// fragments is the number of frames received of the current message.
+	fragments int
 
 	id uint64
 
+	// isClient is whether c is the client endpoint, whose frames are masked.
+	isClient bool
+
+	// createdAt is when the connection was upgraded.
+	createdAt time.Time
+
+	// proto is the negotiated subprotocol.
+	proto string
+
+	// headers are the request headers retained by the Server.
+	headers []requestHeader
+	// path and rawQuery are the path and the query of the upgrade request.
+	path     string
+	rawQuery string
+
+	// compress is whether permessage-deflate or x-webkit-deflate-frame was negotiated.
+	compress bool
+	// legacyDeflate is whether the compression is x-webkit-deflate-frame.
+	legacyDeflate bool
+	// inflateWindow are the last bytes decompressed using x-webkit-deflate-frame.
+	inflateWindow []byte
+	// compressionLevel and noWriteCompression are accessed atomically.
+	compressionLevel   int32
+	noWriteCompression int32
+
+	// binaryWrites is set atomically when Write sends binary messages.
+	binaryWrites int32
+
+	logger Logger
+
 	// ReadTimeout ...
 	ReadTimeout time.Duration
 
 	// WriteTimeout ...
 	WriteTimeout time.Duration
 
-	// MaxPayloadSize prevents huge memory allocation.
+	// MaxFragments is the maximum number of frames a message can be split into.
 	//
-	// By default MaxPayloadSize is DefaultPayloadSize.
-	MaxPayloadSize uint64
+	// The connection is closed with StatusPolicyViolation when a message
+	// exceeds it, so peers can't send lots of tiny continuation frames.
+	// Zero disables the check.
+	MaxFragments int
+
+	// CompressionThreshold is the minimum payload size in bytes
+	// of the messages compressed when permessage-deflate is negotiated.
+	//
+	// Compressing small messages wastes CPU and can even make them bigger.
+	// By default CompressionThreshold is DefaultCompressionThreshold.
+	// Zero compresses every message.
+	CompressionThreshold int
 
 	wg sync.WaitGroup
 
@@ -53,14 +194,158 @@ func (c *Conn) ID() uint64 {
 	return c.id
 }
 
+// CreatedAt returns when the connection was upgraded.
+func (c *Conn) CreatedAt() time.Time {
+	return c.createdAt
+}
+
+// Uptime returns how long the connection has been open.
+func (c *Conn) Uptime() time.Duration {
+	return time.Since(c.createdAt)
+}
+
 // UserValue returns the key associated value.
 func (c *Conn) UserValue(key string) interface{} {
-	return c.ctx.Value(key)
+	return c.Context().Value(key)
 }
 
 // SetUserValue assigns a key to the given value
 func (c *Conn) SetUserValue(key string, value interface{}) {
-	c.ctx = context.WithValue(c.ctx, key, value)
+	c.ctx = context.WithValue(c.Context(), key, value)
+}
+
+// UserInt returns the integer associated to key by SetUserInt.
+//
+// ok is false if the key is not set or the value is not an int64.
+func (c *Conn) UserInt(key string) (v int64, ok bool) {
+	v, ok = c.UserValue(key).(int64)
+	return
+}
+
+// SetUserInt assigns a key to the given integer.
+func (c *Conn) SetUserInt(key string, v int64) {
+	c.SetUserValue(key, v)
+}
+
+// UserString returns the string associated to key by SetUserString.
+//
+// ok is false if the key is not set or the value is not a string.
+func (c *Conn) UserString(key string) (v string, ok bool) {
+	v, ok = c.UserValue(key).(string)
+	return
+}
+
+// SetUserString assigns a key to the given string.
+func (c *Conn) SetUserString(key string, v string) {
+	c.SetUserValue(key, v)
+}
+
+// RequestHeader returns the value of the upgrade request's header key.
+//
+// Only the headers listed in Server.RetainHeaders are kept,
+// an empty string is returned for any other header.
+func (c *Conn) RequestHeader(key string) string {
+	for _, h := range c.headers {
+		if strings.EqualFold(h.key, key) {
+			return h.value
+		}
+	}
+
+	return ""
+}
+
+// Path returns the path of the upgrade request.
+//
+// The path is kept after the upgrade, so the handlers can route
+// the connections upgraded from different paths.
+func (c *Conn) Path() string {
+	return c.path
+}
+
+// QueryArgs returns the query arguments of the upgrade request.
+//
+// The query is parsed on each call, so the map returned can be modified.
+// Malformed arguments are skipped.
+func (c *Conn) QueryArgs() map[string][]string {
+	args, _ := url.ParseQuery(c.rawQuery)
+
+	return args
+}
+
+// requestHeader is a header of the upgrade request.
+type requestHeader struct {
+	key   string
+	value string
+}
+
+// Context returns the connection's context.
+//
+// For connections upgraded using NetUpgrade the context is the request's context.
+// The connection is closed when the context is cancelled.
+func (c *Conn) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+
+	return c.ctx
+}
+
+// WithContext replaces the connection's context with ctx.
+//
+// The user values are taken from ctx, so ctx should be derived
+// from Context. WithContext must be called from the handlers.
+func (c *Conn) WithContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+// IsClient returns whether c is the client endpoint of the connection.
+//
+// The connections served by Server are the server endpoints, the client
+// endpoint returned by Pipe masks the frames it writes.
+func (c *Conn) IsClient() bool {
+	return c.isClient
+}
+
+// SetCompressionLevel sets the flate compression level of the outgoing messages.
+//
+// The level must be between flate.HuffmanOnly and flate.BestCompression.
+// It only takes effect if permessage-deflate was negotiated (see Server.EnableCompression).
+func (c *Conn) SetCompressionLevel(level int) error {
+	if !isValidCompressionLevel(level) {
+		return ErrCompressionLevel
+	}
+
+	atomic.StoreInt32(&c.compressionLevel, int32(level))
+
+	return nil
+}
+
+// EnableWriteCompression enables or disables the compression of the outgoing messages.
+//
+// The compression is enabled by default when permessage-deflate was negotiated.
+// The incoming messages are decompressed anyway.
+func (c *Conn) EnableWriteCompression(enable bool) {
+	var v int32
+	if !enable {
+		v = 1
+	}
+
+	atomic.StoreInt32(&c.noWriteCompression, v)
+}
+
+// LogFields returns the key-value pairs identifying the connection in the logs.
+func (c *Conn) LogFields() []interface{} {
+	return []interface{}{
+		"conn_id", c.id,
+		"remote_addr", c.RemoteAddr().String(),
+		"protocol", c.proto,
+	}
+}
+
+func (c *Conn) logf(format string, args ...interface{}) {
+	if c.logger != nil {
+		c.logger.Printf(format+" %v", append(args, c.LogFields())...)
+	}
 }
 
 // LocalAddr returns local address.
@@ -73,60 +358,241 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.c.RemoteAddr()
 }
 
+// BytesRead returns the number of bytes read from the connection,
+// including the frame headers.
+func (c *Conn) BytesRead() uint64 {
+	return atomic.LoadUint64(&c.bytesRead)
+}
+
+// PendingReadBytes returns the size of the fragmented message
+// being buffered until its last frame is received.
+func (c *Conn) PendingReadBytes() int {
+	return int(atomic.LoadInt64(&c.pendingRead))
+}
+
+// ReadBlocked returns whether the connection stopped reading because
+// the frames read are waiting for the handlers, that is, the handlers
+// are too slow to consume the frames sent by the peer.
+//
+// It's always false unless the frames are read ahead, see Server.ReadBufferFrames.
+func (c *Conn) ReadBlocked() bool {
+	return atomic.LoadInt32(&c.readBlocked) == 1
+}
+
+// BytesWritten returns the number of bytes written into the connection,
+// including the frame headers.
+func (c *Conn) BytesWritten() uint64 {
+	return atomic.LoadUint64(&c.bytesWritten)
+}
+
+// ConnectionState returns the TLS state of the underlying connection.
+//
+// The returned boolean is false if the connection is not a TLS connection.
+func (c *Conn) ConnectionState() (tls.ConnectionState, bool) {
+	if tc, ok := c.c.(*tls.Conn); ok {
+		return tc.ConnectionState(), true
+	}
+
+	return tls.ConnectionState{}, false
+}
+
+var (
+	readerPool sync.Pool
+	writerPool sync.Pool
+)
+
+// acquireReader returns a bufio.Reader of size bytes reading from r.
+//
+// Only the readers of the default size are pooled.
+func acquireReader(r io.Reader, size int) *bufio.Reader {
+	if size == defaultBufioSize {
+		if br, ok := readerPool.Get().(*bufio.Reader); ok {
+			br.Reset(r)
+			return br
+		}
+	}
+
+	return bufio.NewReaderSize(r, size)
+}
+
+func releaseReader(br *bufio.Reader) {
+	if br.Size() == defaultBufioSize {
+		br.Reset(nil)
+		readerPool.Put(br)
+	}
+}
+
+// acquireWriter returns a bufio.Writer of size bytes writing into w.
+//
+// Only the writers of the default size are pooled.
+func acquireWriter(w io.Writer, size int) *bufio.Writer {
+	if size == defaultBufioSize {
+		if bw, ok := writerPool.Get().(*bufio.Writer); ok {
+			bw.Reset(w)
+			return bw
+		}
+	}
+
+	return bufio.NewWriterSize(w, size)
+}
+
+func releaseWriter(bw *bufio.Writer) {
+	if bw.Size() == defaultBufioSize {
+		bw.Reset(nil)
+		writerPool.Put(bw)
+	}
+}
+
 func acquireConn(c net.Conn) (conn *Conn) {
 	conn = &Conn{}
 	conn.reset(c)
-	conn.wg.Add(2)
-
-	go conn.readLoop()
-	go conn.writeLoop()
+	conn.start()
 
 	return conn
 }
 
+// releaseConn puts the buffers of c back into their pools.
+//
+// It must be called once the connection is closed and both loops exited.
+// c might still be referenced by the user, so the writes check whether
+// the buffered writer was released.
+func releaseConn(c *Conn) {
+	// the frames read but not handled
+	for n := len(c.input); n > 0; n-- {
+		ReleaseFrame(<-c.input)
+	}
+
+	if c.buffered != nil {
+		bytebufferpool.Put(c.buffered)
+		c.buffered = nil
+	}
+
+	releaseReader(c.br)
+	c.br = nil
+
+	c.bwmu.Lock()
+	releaseWriter(c.bw)
+	c.bw = nil
+	c.bwmu.Unlock()
+}
+
+func (c *Conn) start() {
+	c.startWriting()
+	c.startReading()
+}
+
+func (c *Conn) startWriting() {
+	c.wg.Add(1)
+	go c.writeLoop()
+}
+
+func (c *Conn) startReading() {
+	c.wg.Add(1)
+	go c.readLoop()
+}
+
 // DefaultPayloadSize defines the default payload size (when none was defined).
 const DefaultPayloadSize = 1 << 20
 
+// DefaultBufferFrames defines the default number of frames buffered
+// for reading and writing (when none was defined).
+const DefaultBufferFrames = 128
+
 // Reset resets conn values setting c as default connection endpoint.
 func (c *Conn) reset(conn net.Conn) {
-	c.input = make(chan *Frame, 128)
-	c.output = make(chan *Frame, 128)
+	c.input = make(chan *Frame, DefaultBufferFrames)
+	c.output = make(chan *Frame, DefaultBufferFrames)
+	c.flushers = make(chan chan error)
 	c.closer = make(chan struct{}, 1)
+	c.writeDone = make(chan struct{})
+	c.closeReceived = make(chan struct{})
+	c.closeSent = 0
+	c.closeOnce = sync.Once{}
 	c.errch = make(chan error, 2)
+	c.buffered = nil
+	c.bufferedBinary = false
+	c.bufferedCompressed = false
+	c.pendingRead = 0
+	c.readBlocked = 0
+	c.inlineReads = false
+	c.unblock = nil
+	c.readAhead = 0
+	c.readAheadMax = 0
+	c.drained = nil
+	c.reader = nil
+	c.stream = nil
+	c.readingStream = nil
+	c.messages = nil
+	c.messagesClosed = false
+	c.fragments = 0
+	c.MaxFragments = 0
+	c.binaryWrites = 0
+	c.id = 0
+	c.createdAt = time.Now()
 	c.ReadTimeout = 0
 	c.WriteTimeout = 0
 	c.MaxPayloadSize = DefaultPayloadSize
+	c.CompressionThreshold = DefaultCompressionThreshold
 	c.ctx = nil
+	c.proto = ""
+	c.compress = false
+	c.legacyDeflate = false
+	c.inflateWindow = nil
+	c.compressionLevel = flate.DefaultCompression
+	c.noWriteCompression = 0
+	c.logger = nil
+	c.bytesRead = 0
+	c.bytesWritten = 0
+	c.lastActive = time.Now().UnixNano()
 	c.c = conn
-	c.br = bufio.NewReader(conn)
-	c.bw = bufio.NewWriter(conn)
+	c.cw = countWriter{w: conn}
+	c.br = acquireReader(conn, defaultBufioSize)
+	c.bw = acquireWriter(&c.cw, defaultBufioSize)
 }
 
 func (c *Conn) readLoop() {
 	defer c.wg.Done()
 
 	for {
-		fr := AcquireFrame()
-		fr.SetPayloadSize(c.MaxPayloadSize)
-
-		// if c.ReadTimeout != 0 {
-		// }
+		if !c.waitReadAhead() {
+			return
+		}
 
-		_, err := fr.ReadFrom(c.br)
+		fr, err := c.readFrame()
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				c.logf("websocket: read timeout: %v", err)
+			}
+
 			select {
 			case c.errch <- closeError{err: err}:
 			default:
 			}
 
-			ReleaseFrame(fr)
-
 			break
 		}
 
 		isClose := fr.IsClose()
 
-		c.input <- fr
+		if c.readAheadMax > 0 {
+			atomic.AddInt64(&c.readAhead, int64(len(fr.b)))
+		}
+
+		select {
+		case c.input <- fr:
+		default:
+			// the handlers can't keep up with the frames read
+			atomic.StoreInt32(&c.readBlocked, 1)
+
+			// the server stops handling the frames once the connection is closed
+			select {
+			case c.input <- fr:
+				atomic.StoreInt32(&c.readBlocked, 0)
+			case <-c.closer:
+				ReleaseFrame(fr)
+				return
+			}
+		}
 
 		if isClose {
 			break
@@ -134,6 +600,91 @@ func (c *Conn) readLoop() {
 	}
 }
 
+// waitReadAhead waits until the payload of the frames read ahead
+// is below the Server.ReadBufferBytes, so the connection is not read
+// meanwhile. It returns false if the connection is closed.
+func (c *Conn) waitReadAhead() bool {
+	if c.readAheadMax == 0 {
+		return true
+	}
+
+	for atomic.LoadInt64(&c.readAhead) >= c.readAheadMax {
+		atomic.StoreInt32(&c.readBlocked, 1)
+
+		select {
+		case <-c.drained:
+		case <-c.closer:
+			return false
+		}
+	}
+
+	atomic.StoreInt32(&c.readBlocked, 0)
+
+	return true
+}
+
+// takeFrame accounts fr, read ahead by the read loop, as handled.
+func (c *Conn) takeFrame(fr *Frame) {
+	if c.readAheadMax == 0 {
+		return
+	}
+
+	if atomic.AddInt64(&c.readAhead, -int64(len(fr.b))) < c.readAheadMax {
+		select {
+		case c.drained <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// readFrame reads the next frame from the connection.
+func (c *Conn) readFrame() (*Frame, error) {
+	fr := AcquireFrame()
+
+	n, err := fr.readHeader(c.br)
+	if err == nil {
+		// the limit is loaded once the header is read,
+		// so SetMaxPayloadSize applies to the next frame received.
+		fr.SetPayloadSize(c.maxPayloadSize())
+
+		var m int64
+		m, err = fr.readPayload(c.br)
+		n += m
+	}
+
+	atomic.AddUint64(&c.bytesRead, uint64(n))
+	c.touch()
+
+	if err != nil {
+		ReleaseFrame(fr)
+		return nil, err
+	}
+
+	return fr, nil
+}
+
+// SetMaxPayloadSize sets the MaxPayloadSize.
+//
+// It's safe to call it while the connection is being read, like from the OpenHandler,
+// and it applies from the next frame read.
+func (c *Conn) SetMaxPayloadSize(n uint64) {
+	atomic.StoreUint64(&c.MaxPayloadSize, n)
+}
+
+func (c *Conn) maxPayloadSize() uint64 {
+	return atomic.LoadUint64(&c.MaxPayloadSize)
+}
+
+// touch records the connection activity for the Server.IdleTimeout.
+func (c *Conn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// idleFor returns the time elapsed since the last frame was read or written.
+func (c *Conn) idleFor() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&c.lastActive))
+}
+
 type closeError struct {
 	err error
 }
@@ -148,23 +699,35 @@ func (ce closeError) Error() string {
 
 func (c *Conn) writeLoop() {
 	defer c.wg.Done()
+	if c.inlineReads {
+		defer c.unblockRead()
+	}
+	defer close(c.writeDone)
 
 loop:
 	for {
 		select {
 		case fr := <-c.output:
-			if err := c.writeFrame(fr); err != nil {
-				select {
-				case c.errch <- closeError{err}:
-				default:
-				}
+			isClose, err := c.writeBatch(fr)
+			if err != nil && c.writeFailed(err) {
+				return
 			}
 
-			isClose := fr.IsClose()
+			if isClose {
+				return
+			}
+		case ch := <-c.flushers:
+			var err error
+			for err == nil && len(c.output) > 0 {
+				_, err = c.writeBatch(<-c.output)
+				if err != nil && !c.writeFailed(err) {
+					err = nil
+				}
+			}
 
-			ReleaseFrame(fr)
+			ch <- err
 
-			if isClose {
+			if err != nil {
 				return
 			}
 		case <-c.closer:
@@ -172,74 +735,776 @@ loop:
 		}
 	}
 
-	// flush all the frames
-	for n := len(c.output); n >= 0; n-- {
-		fr, ok := <-c.output
-		if !ok {
-			break
-		}
-
-		if err := c.writeFrame(fr); err != nil {
+	// flush all the frames, up to the close frame
+	for len(c.output) > 0 {
+		isClose, err := c.writeBatch(<-c.output)
+		if err != nil || isClose {
 			break
 		}
 	}
 }
 
-func (c *Conn) writeFrame(fr *Frame) error {
-	fr.SetPayloadSize(c.MaxPayloadSize)
+// unblockRead bounds the wait for the peer's close frame once c is closed,
+// since the frames read inline are not abandoned like the read loop's.
+//
+// Not every net.Conn interrupts a read in progress when the deadline
+// changes, so the connection is closed if the deadline didn't.
+func (c *Conn) unblockRead() {
+	<-c.closer
+
+	c.c.SetReadDeadline(time.Now().Add(closeWriteTimeout))
+
+	nc := c.c
+	c.unblock = time.AfterFunc(closeWriteTimeout, func() {
+		nc.Close()
+	})
+}
 
+// writeBatch writes fr followed by the frames queued at the moment,
+// flushing them at once to reduce the number of writes into the connection.
+//
+// The batch stops after a close frame. A temporary error drops the whole batch.
+func (c *Conn) writeBatch(fr *Frame) (isClose bool, err error) {
+	var deadline time.Time
 	if c.WriteTimeout > 0 {
-		c.c.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
-		defer c.c.SetWriteDeadline(time.Time{})
+		deadline = time.Now().Add(c.WriteTimeout)
 	}
 
-	_, err := fr.WriteTo(c.bw)
-	if err == nil {
-		err = c.bw.Flush()
+	c.bwmu.Lock()
+	defer c.bwmu.Unlock()
+
+	if !deadline.IsZero() {
+		c.c.SetWriteDeadline(deadline)
+		defer c.c.SetWriteDeadline(time.Time{})
 	}
 
-	return err
-}
+	c.cw.n = 0
 
-func (c *Conn) Ping(data []byte) {
-	fr := AcquireFrame()
-	fr.SetPing()
-	fr.SetFin()
-	fr.SetPayload(data)
+	var n int64
 
-	c.WriteFrame(fr)
-}
+	// the batch is bounded by the frames queued when it started,
+	// and it ends once the buffer fills, so the control frames
+	// written by WriteControl can be sent between the big frames.
+	for queued := len(c.output); ; queued-- {
+		c.prepareFrame(fr)
+		isClose = fr.IsClose()
 
-func (c *Conn) Write(data []byte) (int, error) {
-	n := len(data)
+		var m int64
+		m, err = fr.WriteTo(c.bw)
+		n += m
 
-	fr := AcquireFrame()
+		ReleaseFrame(fr)
 
-	fr.SetFin()
-	fr.SetPayload(data)
-	fr.SetText()
+		if err != nil || isClose || queued == 0 || c.cw.n > 0 {
+			break
+		}
 
-	c.WriteFrame(fr)
+		fr = <-c.output
+	}
 
-	return n, nil
-}
+	if err == nil {
+		err = c.bw.Flush()
+	}
 
-func (c *Conn) WriteFrame(fr *Frame) {
-	c.output <- fr
+	if err == nil {
+		atomic.AddUint64(&c.bytesWritten, uint64(n))
+		c.touch()
+	} else {
+		err = c.recoverWrite(err)
+	}
+
+	return isClose, err
 }
 
-func (c *Conn) Close() error {
-	c.CloseDetail(StatusNone, "")
+// prepareFrame readies fr to be written, masking it if c is the client endpoint.
+func (c *Conn) prepareFrame(fr *Frame) {
+	fr.SetPayloadSize(c.maxPayloadSize())
 
-	return nil
+	if c.isClient && !fr.IsMasked() {
+		fr.Mask()
+	}
 }
 
-func (c *Conn) CloseDetail(status StatusCode, reason string) {
-	if !c.isClosed() {
-		fr := AcquireFrame()
-		fr.SetClose()
-		fr.SetStatus(status)
-		fr.SetFin()
+func (c *Conn) writeFrameDeadline(fr *Frame, deadline time.Time) error {
+	c.prepareFrame(fr)
+
+	c.bwmu.Lock()
+	defer c.bwmu.Unlock()
+
+	// the buffers were released
+	if c.bw == nil {
+		return ErrConnClosed
+	}
+
+	if !deadline.IsZero() {
+		c.c.SetWriteDeadline(deadline)
+		defer c.c.SetWriteDeadline(time.Time{})
+	}
+
+	c.cw.n = 0
+
+	n, err := fr.WriteTo(c.bw)
+	if err == nil {
+		err = c.bw.Flush()
+	}
+
+	if err == nil {
+		atomic.AddUint64(&c.bytesWritten, uint64(n))
+		c.touch()
+	} else {
+		err = c.recoverWrite(err)
+	}
+
+	return err
+}
+
+// countWriter counts the bytes written into the connection.
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += n
+
+	return n, err
+}
+
+// temporaryWriteError is a write error that didn't desynchronize
+// the stream, so the connection can still be used.
+type temporaryWriteError struct {
+	err error
+}
+
+func (te temporaryWriteError) Unwrap() error {
+	return te.err
+}
+
+func (te temporaryWriteError) Error() string {
+	return te.err.Error()
+}
+
+// recoverWrite checks whether the connection can be used after err.
+//
+// A write error is temporary if nothing of the frame reached the connection
+// and the error is a timeout or io.ErrShortWrite. Any other error is fatal.
+// For temporary errors the frame is discarded and a temporaryWriteError is returned.
+//
+// bwmu must be held by the caller.
+func (c *Conn) recoverWrite(err error) error {
+	if c.cw.n != 0 {
+		return err
+	}
+
+	if ne, ok := err.(net.Error); err != io.ErrShortWrite && (!ok || !ne.Timeout()) {
+		return err
+	}
+
+	// drop the frame, the buffered writer is unusable after an error
+	c.bw.Reset(&c.cw)
+
+	return temporaryWriteError{err}
+}
+
+// writeFailed handles the error returned by writeFrame.
+//
+// Temporary errors are reported to the ErrorHandler, otherwise the
+// connection is aborted. writeFailed returns whether the error was fatal.
+func (c *Conn) writeFailed(err error) bool {
+	te, ok := err.(temporaryWriteError)
+	if !ok {
+		c.abort(err)
+		return true
+	}
+
+	c.logf("websocket: temporary write error: %v", te.err)
+
+	select {
+	case c.errch <- te.err:
+	default:
+	}
+
+	return false
+}
+
+// abort tears down the connection after a failed write.
+//
+// A failed flush might have left part of a frame on the wire,
+// so the stream is no longer in sync with the peer and no other
+// frame can be written. The error is reported to the server loop
+// and the underlying connection is closed.
+func (c *Conn) abort(err error) {
+	c.logf("websocket: write error: %v", err)
+
+	select {
+	case c.errch <- closeError{err}:
+	default:
+	}
+
+	c.closeOnce.Do(func() { close(c.closer) })
+
+	c.c.Close()
+}
+
+// flush waits until all the queued frames are written into the connection.
+//
+// wmu must be held by the caller, so no other frame can be queued meanwhile.
+func (c *Conn) flush() error {
+	ch := make(chan error, 1)
+
+	select {
+	case c.flushers <- ch:
+		return <-ch
+	case <-c.closer:
+		return ErrConnClosed
+	}
+}
+
+// WriteVectored writes bufs as the payload of a single frame
+// without concatenating them first.
+//
+// The frame header is written once, followed by each of the buffers.
+// The total length of bufs must not exceed MaxPayloadSize.
+func (c *Conn) WriteVectored(isBinary bool, bufs ...[]byte) (int, error) {
+	n := 0
+	for _, b := range bufs {
+		n += len(b)
+	}
+
+	if max := c.maxPayloadSize(); max > 0 && uint64(n) > max {
+		return 0, errLenTooBig
+	}
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetFin()
+	if isBinary {
+		fr.SetBinary()
+	} else {
+		fr.SetText()
+	}
+
+	// the payload of the client endpoint is masked, so it's copied
+	if c.isClient {
+		for _, b := range bufs {
+			fr.Write(b)
+		}
+
+		bufs = c.appendFrameParts(nil, fr)
+	} else {
+		s := fr.setPayloadLenTo(n)
+		bufs = append([][]byte{fr.op[:s+2]}, bufs...)
+	}
+
+	if _, err := c.writeDirect(bufs...); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// appendFrameParts appends the header, the mask and the payload of fr to bufs,
+// masking fr first if c is the client endpoint.
+func (c *Conn) appendFrameParts(bufs [][]byte, fr *Frame) [][]byte {
+	if c.isClient && !fr.IsMasked() {
+		fr.Mask()
+	}
+
+	s := fr.setPayloadLen()
+
+	bufs = append(bufs, fr.op[:s+2])
+	if fr.IsMasked() {
+		bufs = append(bufs, fr.mask)
+	}
+
+	return append(bufs, fr.b)
+}
+
+// writeDirect writes bufs into the connection bypassing the queue,
+// returning the number of bytes written.
+//
+// The frames queued before are written first, and no frame of
+// other writers can be interleaved within bufs.
+func (c *Conn) writeDirect(bufs ...[]byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	// the frames queued before must be written first
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
+
+	c.bwmu.Lock()
+	defer c.bwmu.Unlock()
+
+	// the buffers were released
+	if c.bw == nil {
+		return 0, ErrConnClosed
+	}
+
+	if c.WriteTimeout > 0 {
+		c.c.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+		defer c.c.SetWriteDeadline(time.Time{})
+	}
+
+	c.cw.n = 0
+
+	var err error
+
+	n := 0
+	for i := 0; err == nil && i < len(bufs); i++ {
+		_, err = c.bw.Write(bufs[i])
+		n += len(bufs[i])
+	}
+
+	if err == nil {
+		err = c.bw.Flush()
+	}
+
+	if err != nil {
+		if te, ok := c.recoverWrite(err).(temporaryWriteError); ok {
+			return 0, te.err
+		}
+
+		c.abort(err)
+		return 0, err
+	}
+
+	atomic.AddUint64(&c.bytesWritten, uint64(n))
+	c.touch()
+
+	return n, nil
+}
+
+// WriteRaw writes p into the connection as is, without framing it.
+//
+// It allows proxies to forward the frames already serialized, i.e. read
+// by a FrameHandler. The caller is responsible for p holding whole valid
+// frames: no frame of other writers can be interleaved within p, but
+// a partial frame desynchronizes the stream with the peer.
+// p isn't masked either, even if c is the client endpoint.
+// Like WriteVectored, the frames queued before are written first.
+func (c *Conn) WriteRaw(p []byte) (int, error) {
+	return c.writeDirect(p)
+}
+
+// WriteControl writes the control frame fr into the connection
+// using deadline as the write deadline.
+//
+// Unlike WriteFrame, fr doesn't wait for the queued frames to be written,
+// it's only written after the frame currently being written. This way pings and close
+// frames are not delayed by big messages. fr is not released by WriteControl.
+//
+// If fr is not a control frame ErrNotControl is returned.
+// Writing a close frame doesn't close the connection, see CloseDetail.
+func (c *Conn) WriteControl(fr *Frame, deadline time.Time) error {
+	if !fr.IsControl() {
+		return ErrNotControl
+	}
+
+	if len(fr.b) > maxControlPayloadSize {
+		return errLenTooBig
+	}
+
+	if c.isClosed() {
+		return ErrConnClosed
+	}
+
+	err := c.writeFrameDeadline(fr, deadline)
+	if te, ok := err.(temporaryWriteError); ok {
+		return te.err
+	}
+
+	if err != nil && err != ErrConnClosed {
+		c.abort(err)
+	}
+
+	return err
+}
+
+// maxControlPayloadSize is the maximum payload size of a control frame.
+const maxControlPayloadSize = 125
+
+// Ping queues a ping frame with data as the payload.
+//
+// It returns an error if data exceeds the 125 bytes allowed
+// in a control frame, or ErrConnClosed if the connection is closed.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayloadSize {
+		return errLenTooBig
+	}
+
+	fr := AcquireFrame()
+	fr.SetPing()
+	fr.SetFin()
+	fr.SetPayload(data)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if !c.queue(fr) {
+		return ErrConnClosed
+	}
+
+	return nil
+}
+
+// Pong queues an unsolicited pong frame with data as the payload.
+//
+// The peer doesn't reply to it, so it can be used as a unidirectional heartbeat.
+// Like Ping, it returns an error if data exceeds the 125 bytes allowed
+// in a control frame, or ErrConnClosed if the connection is closed.
+func (c *Conn) Pong(data []byte) error {
+	if len(data) > maxControlPayloadSize {
+		return errLenTooBig
+	}
+
+	fr := AcquireFrame()
+	fr.SetPong()
+	fr.SetFin()
+	fr.SetPayload(data)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if !c.queue(fr) {
+		return ErrConnClosed
+	}
+
+	return nil
+}
+
+// SetDefaultMessageType sets the type of the messages sent by Write and WriteSync.
+//
+// By default they are text messages, so binary must be true to use Conn as
+// an io.Writer of binary protocols, i.e. using fmt.Fprintf.
+func (c *Conn) SetDefaultMessageType(binary bool) {
+	var v int32
+	if binary {
+		v = 1
+	}
+
+	atomic.StoreInt32(&c.binaryWrites, v)
+}
+
+// setMessageType sets the type of fr set by SetDefaultMessageType.
+func (c *Conn) setMessageType(fr *Frame) {
+	if atomic.LoadInt32(&c.binaryWrites) == 1 {
+		fr.SetBinary()
+	} else {
+		fr.SetText()
+	}
+}
+
+// Write writes data as a message, a text message unless
+// SetDefaultMessageType is used.
+func (c *Conn) Write(data []byte) (int, error) {
+	n := len(data)
+
+	fr := AcquireFrame()
+
+	fr.SetFin()
+	fr.SetPayload(data)
+	c.setMessageType(fr)
+
+	c.WriteFrame(fr)
+
+	return n, nil
+}
+
+// WriteSync writes data as a message like Write, but it waits until
+// the frame is written into the connection.
+//
+// Write only queues the frame, so the write errors are never returned.
+// WriteSync returns the error writing the frame instead, including
+// the timeout when the peer doesn't consume the data within the WriteTimeout.
+func (c *Conn) WriteSync(data []byte) (int, error) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetFin()
+	fr.SetPayload(data)
+	c.setMessageType(fr)
+
+	c.compressFrame(fr)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	// the frames queued before must be written first
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
+
+	var deadline time.Time
+	if c.WriteTimeout > 0 {
+		deadline = time.Now().Add(c.WriteTimeout)
+	}
+
+	err := c.writeFrameDeadline(fr, deadline)
+	if te, ok := err.(temporaryWriteError); ok {
+		return 0, te.err
+	}
+
+	if err != nil {
+		if err != ErrConnClosed {
+			c.abort(err)
+		}
+
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// WriteFragments writes a message splitting it in one frame per fragment.
+//
+// All the frames are queued while holding the write lock, so frames from other
+// writers can't be interleaved between the fragments of the message.
+func (c *Conn) WriteFragments(isBinary bool, fragments ...[]byte) (int, error) {
+	n := 0
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	for i, b := range fragments {
+		fr := AcquireFrame()
+
+		switch {
+		case i != 0:
+			fr.SetContinuation()
+		case isBinary:
+			fr.SetBinary()
+		default:
+			fr.SetText()
+		}
+
+		if i == len(fragments)-1 {
+			fr.SetFin()
+		}
+
+		fr.SetPayload(b)
+		n += len(b)
+
+		if !c.queue(fr) {
+			return 0, ErrConnClosed
+		}
+	}
+
+	return n, nil
+}
+
+// readFromChunkSize is the payload size of the frames written by ReadFrom.
+const readFromChunkSize = 4096
+
+// ReadFrom implements io.ReaderFrom.
+//
+// ReadFrom streams r as a single binary message, sending one frame per chunk
+// read until r returns io.EOF. The FIN bit is only set on the last frame.
+//
+// r is read without holding the connection, so control frames, like the ones
+// sent by Ping or Close, can be written meanwhile. Like MessageStream, other
+// messages must not be written until ReadFrom returns, otherwise their frames
+// are interleaved with ReadFrom's ones.
+//
+// If r returns any other error the message can't be completed,
+// so the connection is closed with StatusUnexpected.
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := c.readFrom(r)
+	if err != nil && err != ErrConnClosed {
+		c.CloseDetail(StatusUnexpected, "")
+	}
+
+	return n, err
+}
+
+func (c *Conn) readFrom(r io.Reader) (int64, error) {
+	var n int64
+
+	b := make([]byte, readFromChunkSize)
+
+	for i := 0; ; i++ {
+		m, err := io.ReadFull(r, b)
+		n += int64(m)
+
+		isEOF := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !isEOF {
+			return n, err
+		}
+
+		fr := AcquireFrame()
+		if i == 0 {
+			fr.SetBinary()
+		} else {
+			fr.SetContinuation()
+		}
+
+		if isEOF {
+			fr.SetFin()
+		}
+
+		fr.SetPayload(b[:m])
+
+		c.wmu.Lock()
+		ok := c.queue(fr)
+		c.wmu.Unlock()
+
+		if !ok {
+			return n, ErrConnClosed
+		}
+
+		if isEOF {
+			return n, nil
+		}
+	}
+}
+
+// PreparedPrefix is the shared head of a message that is sent to many
+// connections with a different tail each.
+//
+// Use NewPreparedPrefix to create one and Conn.WritePrefixed to send it.
+type PreparedPrefix struct {
+	// b is the first frame of the message, already encoded.
+	b []byte
+	// n is the length of the prefix.
+	n int
+}
+
+// NewPreparedPrefix encodes the first frame of the message, holding prefix,
+// so it's written as is into every connection.
+func NewPreparedPrefix(isBinary bool, prefix []byte) *PreparedPrefix {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if isBinary {
+		fr.SetBinary()
+	} else {
+		fr.SetText()
+	}
+
+	s := fr.setPayloadLenTo(len(prefix))
+
+	b := make([]byte, 0, s+2+len(prefix))
+	b = append(b, fr.op[:s+2]...)
+	b = append(b, prefix...)
+
+	return &PreparedPrefix{
+		b: b,
+		n: len(prefix),
+	}
+}
+
+// WritePrefixed writes a message made of the shared prefix p followed by tail.
+//
+// The prefix is sent as the first frame and tail as the final continuation frame,
+// thus the peer receives a single message. Only the header of the tail is encoded.
+// Like WriteVectored, the frames are written after the frames queued before.
+func (c *Conn) WritePrefixed(p *PreparedPrefix, tail []byte) (int, error) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetContinuation()
+	fr.SetFin()
+
+	var bufs [][]byte
+
+	// the client endpoint masks both frames, so the prefix is encoded again
+	if c.isClient {
+		prefix := AcquireFrame()
+		defer ReleaseFrame(prefix)
+
+		prefix.op[0] = p.b[0]
+		prefix.SetPayload(p.b[len(p.b)-p.n:])
+		fr.SetPayload(tail)
+
+		bufs = c.appendFrameParts(bufs, prefix)
+		bufs = c.appendFrameParts(bufs, fr)
+	} else {
+		s := fr.setPayloadLenTo(len(tail))
+		bufs = [][]byte{p.b, fr.op[:s+2], tail}
+	}
+
+	if _, err := c.writeDirect(bufs...); err != nil {
+		return 0, err
+	}
+
+	return p.n + len(tail), nil
+}
+
+// WriteFrame queues fr to be written into the connection.
+//
+// WriteFrame is safe for concurrent use. Fragmented messages must
+// be written using WriteFragments, otherwise their frames might be interleaved.
+func (c *Conn) WriteFrame(fr *Frame) {
+	c.wmu.Lock()
+	c.queue(fr)
+	c.wmu.Unlock()
+}
+
+// TryWriteFrame queues fr like WriteFrame but without blocking.
+//
+// If the write buffer is full, another writer is holding the connection
+// or the connection is closed, fr is released and TryWriteFrame returns false.
+// It allows broadcasters to skip or disconnect slow peers.
+func (c *Conn) TryWriteFrame(fr *Frame) bool {
+	if !c.wmu.TryLock() {
+		ReleaseFrame(fr)
+		return false
+	}
+	defer c.wmu.Unlock()
+
+	c.compressFrame(fr)
+
+	select {
+	case <-c.closer:
+	default:
+		select {
+		case c.output <- fr:
+			return true
+		default:
+		}
+	}
+
+	ReleaseFrame(fr)
+
+	return false
+}
+
+// queue sends fr to the write loop.
+//
+// If the connection has been closed fr is released and queue returns false.
+func (c *Conn) queue(fr *Frame) bool {
+	// the frames must not be queued after closing, even if output has room
+	if c.isClosed() {
+		ReleaseFrame(fr)
+		return false
+	}
+
+	c.compressFrame(fr)
+
+	select {
+	case c.output <- fr:
+		return true
+	case <-c.closer:
+		ReleaseFrame(fr)
+		return false
+	}
+}
+
+func (c *Conn) Close() error {
+	c.CloseDetail(StatusNone, "")
+
+	return nil
+}
+
+func (c *Conn) CloseDetail(status StatusCode, reason string) {
+	if !c.isClosed() {
+		fr := AcquireFrame()
+		fr.SetClose()
+		fr.SetStatus(status)
+		fr.SetFin()
 
 		io.WriteString(fr, reason)
 
@@ -251,6 +1516,110 @@ func (c *Conn) CloseDetail(status StatusCode, reason string) {
 	return
 }
 
+// CloseWithReason closes the connection like CloseDetail,
+// sending v encoded as JSON as the reason, so the peer can decode it.
+//
+// The status and the reason must fit in a control frame (125 bytes),
+// otherwise an error is returned and the connection isn't closed.
+// ErrConnClosed is returned if the connection is already closed.
+func (c *Conn) CloseWithReason(status StatusCode, v interface{}) error {
+	reason, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if 2+len(reason) > maxControlPayloadSize {
+		return errLenTooBig
+	}
+
+	if c.isClosed() {
+		return ErrConnClosed
+	}
+
+	c.CloseDetail(status, b2s(reason))
+
+	return nil
+}
+
+// CloseWithTimeout closes the connection like Close, but waits up to d
+// until the close frame and the frames queued before are written.
+//
+// Close can block while the queue is full, i.e. if the peer doesn't read.
+// If the frames aren't written within d, the underlying connection is closed,
+// so the connection's goroutines exit, and ErrCloseTimeout is returned.
+func (c *Conn) CloseWithTimeout(d time.Duration) error {
+	// the connection might be released once the write loop exits
+	nc := c.c
+	writeDone := c.writeDone
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	var err error
+
+	select {
+	case <-writeDone:
+	case <-t.C:
+		// the loops fail reading and writing, tearing down the connection
+		nc.Close()
+		err = ErrCloseTimeout
+	}
+
+	// Close returns once the connection is closed
+	<-closed
+
+	return err
+}
+
+// WriteClose sends a close frame and waits until the peer replies
+// with its own close frame or ctx is done, completing the closing handshake.
+//
+// If ctx is done before the reply is received the connection is closed
+// anyway and ctx.Err() is returned. ErrConnClosed is returned if the connection
+// was closed without receiving the reply.
+//
+// The peer's close frame is handled by the Server, so WriteClose
+// must not be called from the handlers.
+func (c *Conn) WriteClose(ctx context.Context, status StatusCode, reason string) error {
+	if c.isClosed() {
+		return ErrConnClosed
+	}
+
+	fr := AcquireFrame()
+	fr.SetClose()
+	fr.SetStatus(status)
+	fr.SetFin()
+
+	io.WriteString(fr, reason)
+
+	atomic.StoreInt32(&c.closeSent, 1)
+
+	c.WriteFrame(fr)
+
+	select {
+	case <-c.closeReceived:
+		return nil
+	case <-c.closer:
+		// the reply is received right before closing the connection
+		select {
+		case <-c.closeReceived:
+			return nil
+		default:
+			return ErrConnClosed
+		}
+	case <-ctx.Done():
+		c.closeOnce.Do(func() { close(c.closer) })
+
+		return ctx.Err()
+	}
+}
+
 func (c *Conn) isClosed() bool {
 	select {
 	case <-c.closer:
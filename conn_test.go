@@ -2,9 +2,26 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttp/fasthttputil"
@@ -65,23 +82,103 @@ func openConn(t *testing.T, ln *fasthttputil.InmemoryListener) *Client {
 		t.Fatal(err)
 	}
 
-	// TODO: UpgradeAsClient
-	fmt.Fprintf(c, "GET / HTTP/1.1\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\n\r\n")
-
-	br := bufio.NewReader(c)
-	var res fasthttp.Response
-	err = res.Read(br)
+	conn, err := MakeClient(c, "http://localhost/")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	conn := &Client{
-		c: c,
-		brw: bufio.NewReadWriter(
-			bufio.NewReader(c), bufio.NewWriter(c)),
+	return conn
+}
+
+// serveInmemory serves ws using a listener in memory, which is closed
+// once the test ends. The clients are connected using openConn.
+func serveInmemory(t *testing.T, ws *Server) *fasthttputil.InmemoryListener {
+	ln := fasthttputil.NewInmemoryListener()
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
 	}
 
-	return conn
+	done := make(chan struct{})
+	go func() {
+		s.Serve(ln)
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		ln.Close()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Error("timeout closing the listener")
+		}
+	})
+
+	return ln
+}
+
+// dialServer serves ws like serveInmemory and returns a Client connected to it.
+func dialServer(t *testing.T, ws *Server) *Client {
+	return openConn(t, serveInmemory(t, ws))
+}
+
+// servePipe serves s using net.Pipe and returns the peer's end
+// of the connection, which is closed once the test ends.
+func servePipe(t *testing.T, s *Server) net.Conn {
+	c1, c2 := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		s.ServeConn(c1, context.Background())
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		c2.Close()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Error("timeout closing the connection")
+		}
+	})
+
+	return c2
+}
+
+// frameWriter writes the frames of the peer's end of a connection.
+type frameWriter interface {
+	WriteFrame(fr *Frame) (int, error)
+}
+
+// rawConn writes the frames as they are into the connection.
+type rawConn struct {
+	net.Conn
+}
+
+func (c rawConn) WriteFrame(fr *Frame) (int, error) {
+	n, err := fr.WriteTo(c.Conn)
+	return int(n), err
+}
+
+// writeFrame writes a masked frame with code and payload using w.
+func writeFrame(t *testing.T, w frameWriter, code Code, fin bool, payload string) {
+	t.Helper()
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetCode(code)
+	if fin {
+		fr.SetFin()
+	}
+	fr.SetPayload([]byte(payload))
+	fr.Mask()
+
+	if _, err := w.WriteFrame(fr); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestReadFrame(t *testing.T) {
@@ -153,9 +250,13 @@ func TestReadFrame(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// the server replies to the close frame
 	fr.Reset()
 	_, err = conn.ReadFrame(fr)
-	if !fr.IsContinuation() {
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fr.IsClose() {
 		t.Fatalf("Unexpected frame %s", fr.Code())
 	}
 
@@ -217,3 +318,3106 @@ func TestReadFrame(t *testing.T) {
 // 		t.Fatal("timeout")
 // 	}
 // }
+
+func makeTestCert(t *testing.T, cn string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+		},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+func TestConnectionState(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+
+	ws := Server{}
+
+	ch := make(chan string, 1)
+	ws.HandleOpen(func(c *Conn) {
+		state, ok := c.ConnectionState()
+		if !ok || len(state.PeerCertificates) == 0 {
+			ch <- ""
+			return
+		}
+
+		ch <- state.PeerCertificates[0].Subject.CommonName
+	})
+
+	s := fasthttp.Server{
+		Handler: ws.Upgrade,
+	}
+
+	tln := tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{makeTestCert(t, "server")},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.Serve(tln)
+		done <- struct{}{}
+	}()
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := tls.Client(c, &tls.Config{
+		Certificates:       []tls.Certificate{makeTestCert(t, "client")},
+		InsecureSkipVerify: true,
+	})
+
+	conn, err := MakeClient(tc, "https://localhost:9843/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case cn := <-ch:
+		if cn != "client" {
+			t.Fatalf("Expecting client certificate, got %q", cn)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	conn.Close()
+	ln.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestWriteFragmentsConcurrent(t *testing.T) {
+	const (
+		writers   = 32
+		fragments = 8
+	)
+
+	ws := Server{}
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		for i := 0; i < writers; i++ {
+			go func(b byte) {
+				frags := make([][]byte, fragments)
+				for i := range frags {
+					frags[i] = bytes.Repeat([]byte{b}, 512)
+				}
+
+				c.WriteFragments(true, frags...)
+			}(byte(i))
+		}
+	})
+
+	conn := dialServer(t, &ws)
+
+	io.WriteString(conn, "start")
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	for i := 0; i < writers; i++ {
+		var current byte
+
+		for j := 0; j < fragments; j++ {
+			fr.Reset()
+
+			_, err := conn.ReadFrame(fr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if j == 0 {
+				if fr.Code() != CodeBinary {
+					t.Fatalf("Expecting binary frame, got %s", fr.Code())
+				}
+
+				current = fr.Payload()[0]
+			} else if !fr.IsContinuation() {
+				t.Fatalf("Expecting continuation frame, got %s", fr.Code())
+			}
+
+			for _, b := range fr.Payload() {
+				if b != current {
+					t.Fatalf("Interleaved fragments on message %d", current)
+				}
+			}
+
+			if fr.IsFin() != (j == fragments-1) {
+				t.Fatalf("Unexpected FIN bit on fragment %d", j)
+			}
+		}
+	}
+
+	conn.Close()
+}
+
+func TestWriteVectored(t *testing.T) {
+	ws := Server{}
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		io.WriteString(c, "first")
+		c.WriteVectored(true, []byte("Hello"), []byte(" "), []byte("world"))
+	})
+
+	conn := dialServer(t, &ws)
+
+	io.WriteString(conn, "start")
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(fr.Payload()) != "first" {
+		t.Fatalf("Expecting first, got %s", fr.Payload())
+	}
+
+	fr.Reset()
+
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsFin() || fr.Code() != CodeBinary {
+		t.Fatalf("Unexpected frame %s", fr.Code())
+	}
+
+	if string(fr.Payload()) != "Hello world" {
+		t.Fatalf("Expecting Hello world, got %s", fr.Payload())
+	}
+
+	conn.Close()
+}
+
+func TestWriteRaw(t *testing.T) {
+	raw := AcquireFrame()
+	raw.SetBinary()
+	raw.SetFin()
+	raw.SetPayload([]byte("Hello world"))
+
+	bf := bytes.NewBuffer(nil)
+	raw.WriteTo(bf)
+	ReleaseFrame(raw)
+
+	ws := Server{}
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		io.WriteString(c, "first")
+		c.WriteRaw(bf.Bytes())
+	})
+
+	conn := dialServer(t, &ws)
+
+	io.WriteString(conn, "start")
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(fr.Payload()) != "first" {
+		t.Fatalf("Expecting first, got %s", fr.Payload())
+	}
+
+	fr.Reset()
+
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsFin() || fr.Code() != CodeBinary {
+		t.Fatalf("Unexpected frame %s", fr.Code())
+	}
+
+	if string(fr.Payload()) != "Hello world" {
+		t.Fatalf("Expecting Hello world, got %s", fr.Payload())
+	}
+
+	conn.Close()
+}
+
+func TestWritePrefixed(t *testing.T) {
+	long := bytes.Repeat([]byte("a"), 200)
+
+	for _, tc := range []struct {
+		isBinary bool
+		prefix   []byte
+		tail     string
+		expected []byte
+	}{
+		{
+			false, []byte("Hello, "), "world",
+			[]byte("\x01\x07Hello, \x80\x05world"),
+		},
+		{
+			true, long, "!",
+			append(append([]byte{0x02, 126, 0, 200}, long...), 0x80, 1, '!'),
+		},
+	} {
+		p := NewPreparedPrefix(tc.isBinary, tc.prefix)
+
+		// the prefix is shared by the connections
+		for i := 0; i < 2; i++ {
+			c1, c2 := net.Pipe()
+
+			conn := acquireConn(c1)
+
+			type result struct {
+				n   int
+				err error
+			}
+
+			ch := make(chan result, 1)
+			go func() {
+				n, err := conn.WritePrefixed(p, []byte(tc.tail))
+				ch <- result{n, err}
+			}()
+
+			c2.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+			b := make([]byte, len(tc.expected))
+			if _, err := io.ReadFull(c2, b); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(b, tc.expected) {
+				t.Fatalf("Expecting %q, got %q", tc.expected, b)
+			}
+
+			res := <-ch
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+
+			if n := len(tc.prefix) + len(tc.tail); res.n != n {
+				t.Fatalf("Expecting %d bytes written, got %d", n, res.n)
+			}
+
+			c2.Close()
+			conn.Close()
+			conn.wg.Wait()
+		}
+	}
+}
+
+// partialConn writes only half of the first buffer and fails.
+type partialConn struct {
+	net.Conn
+}
+
+func (pc *partialConn) Write(b []byte) (int, error) {
+	n, _ := pc.Conn.Write(b[:len(b)/2])
+	return n, io.ErrShortWrite
+}
+
+func TestWriteAbortOnPartialFlush(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	received := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(c2)
+		received <- b
+	}()
+
+	conn := acquireConn(&partialConn{c1})
+
+	io.WriteString(conn, "Hello")
+	io.WriteString(conn, "world")
+
+	select {
+	case err := <-conn.errch:
+		if !errors.Is(err, io.ErrShortWrite) {
+			t.Fatalf("Expecting %v, got %v", io.ErrShortWrite, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the write error")
+	}
+
+	if !conn.isClosed() {
+		t.Fatal("Expecting the connection to be closed")
+	}
+
+	select {
+	case b := <-received:
+		// both frames might be flushed at once, but only half of the
+		// buffered frames (2 bytes of header + 5 bytes each) reach the wire.
+		if len(b) != 3 && len(b) != 7 || !bytes.HasPrefix([]byte("\x81\x05Hello\x81\x05world"), b) {
+			t.Fatalf("Expecting half of the flushed frames on the wire, got %d: %q", len(b), b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the underlying connection was not closed")
+	}
+
+	if _, err := conn.WriteVectored(false, []byte("again")); err != ErrConnClosed {
+		t.Fatalf("Expecting %v, got %v", ErrConnClosed, err)
+	}
+
+	c1.Close()
+	conn.wg.Wait()
+}
+
+func TestReadFrom(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	conn := acquireConn(c1)
+
+	data := make([]byte, readFromChunkSize*2+100)
+	rand.Read(data)
+
+	errCh := make(chan error, 1)
+	go func() {
+		// HalfReader forces short reads
+		n, err := conn.ReadFrom(iotest.HalfReader(bytes.NewReader(data)))
+		if err == nil && n != int64(len(data)) {
+			err = fmt.Errorf("Expecting %d bytes read, got %d", len(data), n)
+		}
+
+		errCh <- err
+	}()
+
+	br := bufio.NewReader(c2)
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	var got []byte
+	for i := 0; ; i++ {
+		fr.Reset()
+
+		if _, err := fr.ReadFrom(br); err != nil {
+			t.Fatal(err)
+		}
+
+		switch {
+		case i == 0 && fr.Code() != CodeBinary:
+			t.Fatalf("Expecting binary frame, got %s", fr.Code())
+		case i != 0 && !fr.IsContinuation():
+			t.Fatalf("Expecting continuation frame, got %s", fr.Code())
+		}
+
+		got = append(got, fr.Payload()...)
+
+		if fr.IsFin() {
+			if i != 2 {
+				t.Fatalf("Expecting 3 frames, got %d", i+1)
+			}
+
+			break
+		}
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatal("Payload mismatch")
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	c2.Close()
+	conn.Close()
+	conn.wg.Wait()
+}
+
+func TestReadFromBlocked(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	conn := acquireConn(c1)
+
+	pr, pw := io.Pipe()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.ReadFrom(pr)
+		errCh <- err
+	}()
+
+	// the blocked reader doesn't hold the connection
+	go conn.Ping([]byte("ping"))
+
+	br := bufio.NewReader(c2)
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	c2.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	if _, err := fr.ReadFrom(br); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsPing() || string(fr.Payload()) != "ping" {
+		t.Fatalf("Expecting a ping, got %s", fr)
+	}
+
+	io.WriteString(pw, "Hello")
+	pw.Close()
+
+	fr.Reset()
+	if _, err := fr.ReadFrom(br); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsBinary() || !fr.IsFin() || string(fr.Payload()) != "Hello" {
+		t.Fatalf("Expecting a final binary Hello, got %s", fr)
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	c2.Close()
+	conn.Close()
+	conn.wg.Wait()
+}
+
+func TestConnByteCounters(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	conn := acquireConn(c1)
+
+	// 2 bytes header + 2 bytes length + 200 bytes payload
+	payload := make([]byte, 200)
+	conn.Write(payload)
+
+	br := bufio.NewReader(c2)
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := fr.ReadFrom(br); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for conn.BytesWritten() != 204 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := conn.BytesWritten(); n != 204 {
+		t.Fatalf("Expecting 204 bytes written, got %d", n)
+	}
+
+	// 2 bytes header + 4 bytes mask + 5 bytes payload
+	fr.Reset()
+	fr.SetFin()
+	fr.SetText()
+	fr.SetPayload([]byte("Hello"))
+	fr.Mask()
+
+	go fr.WriteTo(c2)
+
+	select {
+	case in := <-conn.input:
+		ReleaseFrame(in)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	if n := conn.BytesRead(); n != 11 {
+		t.Fatalf("Expecting 11 bytes read, got %d", n)
+	}
+
+	c2.Close()
+	conn.Close()
+	conn.wg.Wait()
+}
+
+func TestZeroMaskKey(t *testing.T) {
+	ws := Server{}
+
+	ch := make(chan string, 1)
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		ch <- string(data)
+	})
+
+	conn := dialServer(t, &ws)
+
+	fr := AcquireFrame()
+	fr.SetFin()
+	fr.SetText()
+	fr.SetPayload([]byte("Hello"))
+	// the mask bit is set but the key is all zeros,
+	// so the payload goes out as is
+	fr.SetMask([]byte{0, 0, 0, 0})
+
+	_, err := conn.WriteFrame(fr)
+	ReleaseFrame(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-ch:
+		if data != "Hello" {
+			t.Fatalf("Expecting Hello, got %s", data)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	conn.Close()
+}
+
+type chanLogger chan string
+
+func (l chanLogger) Printf(format string, args ...interface{}) {
+	l <- fmt.Sprintf(format, args...)
+}
+
+func TestConnLogFields(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	logs := make(chanLogger, 1)
+
+	conn := &Conn{}
+	conn.reset(&partialConn{c1})
+	conn.id = 7
+	conn.proto = "chat"
+	conn.logger = logs
+	conn.start()
+
+	go io.Copy(io.Discard, c2)
+
+	io.WriteString(conn, "Hello")
+
+	select {
+	case line := <-logs:
+		expected := fmt.Sprintf("websocket: write error: %v [conn_id 7 remote_addr pipe protocol chat]", io.ErrShortWrite)
+		if line != expected {
+			t.Fatalf("Unexpected log line: %q<>%q", line, expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the log")
+	}
+
+	conn.wg.Wait()
+}
+
+func TestConnContextCancel(t *testing.T) {
+	ws := Server{}
+
+	ws.HandleOpen(func(c *Conn) {
+		ctx, cancel := context.WithTimeout(c.Context(), time.Millisecond*50)
+		c.WithContext(ctx)
+
+		c.SetUserValue("cancel", cancel)
+	})
+
+	errCh := make(chan error, 1)
+	ws.HandleClose(func(c *Conn, err error) {
+		c.UserValue("cancel").(context.CancelFunc)()
+
+		errCh <- err
+	})
+
+	conn := dialServer(t, &ws)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsClose() || fr.Status() != StatusGoAway {
+		t.Fatalf("Expecting close frame with GoAway, got %s", fr)
+	}
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expecting %v, got %v", context.DeadlineExceeded, err)
+		}
+
+		if werr, ok := err.(Error); !ok || werr.Status != StatusGoAway {
+			t.Fatalf("Expecting StatusGoAway, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+}
+
+func TestHandleMessageReader(t *testing.T) {
+	ws := Server{}
+
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		t.Error("The MessageHandler must not be called")
+	})
+
+	first := make(chan string, 1)
+	ch := make(chan string, 2)
+	ws.HandleMessageReader(func(c *Conn, isBinary bool, r io.Reader) {
+		if !isBinary {
+			t.Error("Expecting binary message")
+		}
+
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Error(err)
+		}
+
+		first <- string(b)
+
+		rest, err := io.ReadAll(r)
+		if err != nil {
+			t.Error(err)
+		}
+
+		ch <- string(b) + string(rest)
+	})
+
+	conn := dialServer(t, &ws)
+
+	writeFrame(t, conn, CodeBinary, false, "Hello")
+
+	// the first fragment is delivered before the message is complete
+	select {
+	case s := <-first:
+		if s != "Hello" {
+			t.Fatalf("Expecting Hello, got %s", s)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	writeFrame(t, conn, CodeContinuation, false, " ")
+	writeFrame(t, conn, CodeContinuation, true, "world")
+
+	// single frame message
+	writeFrame(t, conn, CodeBinary, true, "Bye, world")
+	<-first
+
+	for _, expected := range []string{"Hello world", "Bye, world"} {
+		select {
+		case s := <-ch:
+			if s != expected {
+				t.Fatalf("Expecting %s, got %s", expected, s)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+
+	conn.Close()
+}
+
+func TestWriteControl(t *testing.T) {
+	const messages = 16
+
+	c1, c2 := net.Pipe()
+
+	conn := acquireConn(c1)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetText()
+	fr.SetFin()
+	if err := conn.WriteControl(fr, time.Time{}); err != ErrNotControl {
+		t.Fatalf("Expecting %v, got %v", ErrNotControl, err)
+	}
+
+	payload := make([]byte, 4096)
+	for i := 0; i < messages; i++ {
+		conn.Write(payload)
+	}
+
+	// the first message is in flight
+	br := bufio.NewReader(c2)
+	if _, err := fr.ReadFrom(br); err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		ping := AcquireFrame()
+		defer ReleaseFrame(ping)
+
+		ping.SetPing()
+		ping.SetFin()
+		ping.SetPayload([]byte("ping"))
+
+		errCh <- conn.WriteControl(ping, time.Now().Add(time.Second*5))
+	}()
+
+	i := 1
+	for ; i < messages; i++ {
+		time.Sleep(time.Millisecond * 5)
+
+		fr.Reset()
+		if _, err := fr.ReadFrom(br); err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.IsPing() {
+			break
+		}
+	}
+
+	if i == messages {
+		t.Fatal("The ping was queued behind the messages")
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	c2.Close()
+	conn.Close()
+	conn.wg.Wait()
+}
+
+func TestFragmentedMessageWithPing(t *testing.T) {
+	ws := Server{}
+
+	type message struct {
+		isBinary bool
+		data     string
+	}
+
+	ch := make(chan message, 2)
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		ch <- message{isBinary, string(data)}
+	})
+
+	conn := dialServer(t, &ws)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	for _, code := range []Code{CodeText, CodeBinary} {
+		writeFrame(t, conn, code, false, "Hello")
+		writeFrame(t, conn, CodePing, true, "ping")
+		writeFrame(t, conn, CodeContinuation, true, " world")
+
+		fr.Reset()
+		if _, err := conn.ReadFrame(fr); err != nil {
+			t.Fatal(err)
+		}
+
+		if !fr.IsPong() || string(fr.Payload()) != "ping" {
+			t.Fatalf("Expecting pong, got %s", fr)
+		}
+
+		select {
+		case m := <-ch:
+			if m.data != "Hello world" {
+				t.Fatalf("Expecting Hello world, got %s", m.data)
+			}
+
+			if m.isBinary != (code == CodeBinary) {
+				t.Fatalf("Expecting %s message", code)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+
+	conn.Close()
+}
+
+func TestServerBufferFrames(t *testing.T) {
+	s := &Server{}
+
+	c1, c2 := net.Pipe()
+
+	conn := s.acquireConn(c1, context.Background(), nil)
+	if cap(conn.output) != DefaultBufferFrames || conn.input != nil || !conn.inlineReads {
+		t.Fatalf("Expecting %d buffered frames and no read ahead, got %d and %d",
+			DefaultBufferFrames, cap(conn.output), cap(conn.input))
+	}
+
+	c2.Close()
+	conn.Close()
+	conn.wg.Wait()
+
+	s.WriteBufferFrames = 4
+	s.ReadBufferFrames = 2
+
+	c1, c2 = net.Pipe()
+
+	conn = s.acquireConn(c1, context.Background(), nil)
+	if cap(conn.output) != 4 || cap(conn.input) != 2 {
+		t.Fatalf("Expecting 4 and 2 buffered frames, got %d and %d",
+			cap(conn.output), cap(conn.input))
+	}
+
+	c2.Close()
+	conn.Close()
+	conn.wg.Wait()
+}
+
+func TestTryWriteFrame(t *testing.T) {
+	s := &Server{
+		WriteBufferFrames: 2,
+	}
+
+	c1, c2 := net.Pipe()
+
+	conn := s.acquireConn(c1, context.Background(), nil)
+
+	newFrame := func() *Frame {
+		fr := AcquireFrame()
+		fr.SetText()
+		fr.SetFin()
+		fr.SetPayload([]byte("Hello"))
+
+		return fr
+	}
+
+	// the peer is not reading, so the write loop holds one frame
+	// and the other two fill the buffer.
+	queued := 0
+	for i := 0; i < 8; i++ {
+		if conn.TryWriteFrame(newFrame()) {
+			queued++
+		}
+	}
+
+	if queued < 2 || queued > 3 {
+		t.Fatalf("Expecting 2 or 3 queued frames, got %d", queued)
+	}
+
+	c2.Close()
+	conn.Close()
+	conn.wg.Wait()
+
+	if conn.TryWriteFrame(newFrame()) {
+		t.Fatal("Expecting TryWriteFrame to fail on a closed connection")
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// timeoutConn fails the first write without writing anything.
+type timeoutConn struct {
+	net.Conn
+	failed bool
+}
+
+func (tc *timeoutConn) Write(b []byte) (int, error) {
+	if !tc.failed {
+		tc.failed = true
+		return 0, timeoutError{}
+	}
+
+	return tc.Conn.Write(b)
+}
+
+func TestTemporaryWriteError(t *testing.T) {
+	// the read loop reports the error without waiting for a frame
+	s := &Server{
+		ReadBufferFrames: DefaultBufferFrames,
+	}
+
+	errCh := make(chan error, 1)
+	s.HandleError(func(c *Conn, err error) {
+		errCh <- err
+	})
+
+	c1, c2 := net.Pipe()
+
+	conn := s.acquireConn(&timeoutConn{Conn: c1}, context.Background(), nil)
+
+	done := make(chan struct{})
+	go func() {
+		s.serveConn(conn)
+		close(done)
+	}()
+
+	io.WriteString(conn, "Hello")
+
+	select {
+	case err := <-errCh:
+		if _, ok := err.(timeoutError); !ok {
+			t.Fatalf("Expecting timeout error, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	// the connection is still usable
+	io.WriteString(conn, "world")
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := fr.ReadFrom(c2); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(fr.Payload()) != "world" {
+		t.Fatalf("Expecting world, got %s", fr.Payload())
+	}
+
+	c2.Close()
+	conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestDisableAutoPong(t *testing.T) {
+	ws := Server{
+		DisableAutoPong: true,
+	}
+
+	pings := make(chan string, 1)
+	ws.HandlePing(func(c *Conn, data []byte) {
+		pings <- string(data)
+	})
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		c.Write(data)
+	})
+
+	conn := dialServer(t, &ws)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetPing()
+	fr.SetFin()
+	fr.SetPayload([]byte("ping"))
+
+	if _, err := conn.WriteFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-pings:
+		if data != "ping" {
+			t.Fatalf("Expecting ping, got %q", data)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	io.WriteString(conn, "Hello")
+
+	fr.Reset()
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if fr.IsPong() {
+		t.Fatal("Unexpected pong")
+	}
+
+	if s := string(fr.Payload()); s != "Hello" {
+		t.Fatalf("Expecting Hello, got %q", s)
+	}
+
+	conn.Close()
+}
+
+func TestWriteClose(t *testing.T) {
+	ws := Server{}
+
+	errs := make(chan error, 1)
+	closed := make(chan error, 1)
+	ws.HandleOpen(func(c *Conn) {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+
+			errs <- c.WriteClose(ctx, StatusGoAway, "bye")
+		}()
+	})
+	ws.HandleClose(func(c *Conn, err error) {
+		closed <- err
+	})
+
+	conn := dialServer(t, &ws)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsClose() || fr.Status() != StatusGoAway {
+		t.Fatalf("Expecting a close frame with StatusGoAway, got %s", fr)
+	}
+
+	if s := string(fr.Payload()); s != "bye" {
+		t.Fatalf("Expecting bye, got %q", s)
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatalf("WriteClose returned before the reply: %v", err)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	reply := AcquireFrame()
+	defer ReleaseFrame(reply)
+
+	reply.SetClose()
+	reply.SetStatus(StatusGoAway)
+	reply.SetFin()
+
+	if _, err := conn.WriteFrame(reply); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	// the reply must not be echoed back
+	conn.c.SetReadDeadline(time.Now().Add(time.Second))
+
+	fr.Reset()
+	if _, err := conn.ReadFrame(fr); err == nil {
+		t.Fatalf("Unexpected frame: %s", fr)
+	}
+
+	conn.c.Close()
+}
+
+func TestWriteCloseTimeout(t *testing.T) {
+	ws := Server{}
+
+	errs := make(chan error, 1)
+	ws.HandleOpen(func(c *Conn) {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+			defer cancel()
+
+			errs <- c.WriteClose(ctx, StatusNone, "")
+		}()
+	})
+
+	conn := dialServer(t, &ws)
+
+	select {
+	case err := <-errs:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("Expecting context.DeadlineExceeded, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	conn.c.Close()
+}
+
+func TestAbnormalClosure(t *testing.T) {
+	ws := Server{}
+
+	errCh := make(chan error, 1)
+	ws.HandleClose(func(c *Conn, err error) {
+		errCh <- err
+	})
+
+	conn := dialServer(t, &ws)
+
+	// drop the connection without sending a close frame
+	conn.c.Close()
+
+	select {
+	case err := <-errCh:
+		werr, ok := err.(Error)
+		if !ok || werr.Status != StatusAbnormalClosure {
+			t.Fatalf("Expecting StatusAbnormalClosure, got %v", err)
+		}
+
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("Expecting %v, got %v", io.EOF, errors.Unwrap(err))
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+}
+
+func TestHandleCloseFrame(t *testing.T) {
+	ws := Server{}
+
+	received := make(chan string, 1)
+	ws.HandleCloseFrame(func(c *Conn, status StatusCode, reason []byte) (StatusCode, string) {
+		received <- fmt.Sprintf("%d %s", status, reason)
+
+		return StatusGoAway, "shutting down"
+	})
+
+	conn := dialServer(t, &ws)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetClose()
+	fr.SetStatus(StatusViolation)
+	fr.SetFin()
+	io.WriteString(fr, "bad")
+
+	if _, err := conn.WriteFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case s := <-received:
+		if s != "1008 bad" {
+			t.Fatalf("Expecting 1008 bad, got %q", s)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	fr.Reset()
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsClose() || fr.Status() != StatusGoAway {
+		t.Fatalf("Expecting a close frame with StatusGoAway, got %s", fr)
+	}
+
+	if s := string(fr.Payload()); s != "shutting down" {
+		t.Fatalf("Expecting shutting down, got %q", s)
+	}
+
+	conn.c.Close()
+}
+
+func TestHandleCloseFrameLongReason(t *testing.T) {
+	for _, tc := range []struct {
+		reason   string
+		expected string
+	}{
+		{strings.Repeat("a", 200), strings.Repeat("a", 123)},
+		// the last character doesn't fit
+		{strings.Repeat("a", 122) + "é", strings.Repeat("a", 122)},
+	} {
+		ws := Server{}
+		ws.HandleCloseFrame(func(c *Conn, status StatusCode, reason []byte) (StatusCode, string) {
+			return StatusGoAway, tc.reason
+		})
+
+		conn := dialServer(t, &ws)
+
+		fr := AcquireFrame()
+
+		fr.SetClose()
+		fr.SetStatus(StatusNone)
+		fr.SetFin()
+
+		if _, err := conn.WriteFrame(fr); err != nil {
+			t.Fatal(err)
+		}
+
+		fr.Reset()
+		if _, err := conn.ReadFrame(fr); err != nil {
+			t.Fatal(err)
+		}
+
+		if !fr.IsClose() || fr.Status() != StatusGoAway {
+			t.Fatalf("Expecting a close frame with StatusGoAway, got %s", fr)
+		}
+
+		if s := string(fr.Payload()); s != tc.expected {
+			t.Fatalf("Expecting %d bytes, got %q", len(tc.expected), s)
+		}
+
+		ReleaseFrame(fr)
+		conn.c.Close()
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	ws := Server{
+		IdleTimeout: time.Millisecond * 200,
+	}
+
+	errCh := make(chan error, 1)
+	ws.HandleClose(func(c *Conn, err error) {
+		errCh <- err
+	})
+
+	conn := dialServer(t, &ws)
+
+	start := time.Now()
+
+	// the activity keeps the connection open
+	for i := 0; i < 4; i++ {
+		io.WriteString(conn, "Hello")
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected close after %s: %v", time.Since(start), err)
+	default:
+	}
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsClose() || fr.Status() != StatusGoAway {
+		t.Fatalf("Expecting a close frame with StatusGoAway, got %s", fr)
+	}
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrIdleTimeout) {
+			t.Fatalf("Expecting %v, got %v", ErrIdleTimeout, err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	conn.c.Close()
+}
+
+func TestServerBufferSize(t *testing.T) {
+	s := &Server{}
+
+	c1, c2 := net.Pipe()
+
+	conn := s.acquireConn(c1, context.Background(), nil)
+	if conn.br.Size() != 4096 || conn.bw.Size() != 4096 {
+		t.Fatalf("Expecting the bufio default size, got %d and %d", conn.br.Size(), conn.bw.Size())
+	}
+
+	c2.Close()
+	conn.Close()
+	conn.wg.Wait()
+
+	s.ReadBufferSize = 1 << 16
+	s.WriteBufferSize = 1 << 15
+
+	c1, c2 = net.Pipe()
+
+	conn = s.acquireConn(c1, context.Background(), nil)
+	if conn.br.Size() != 1<<16 || conn.bw.Size() != 1<<15 {
+		t.Fatalf("Expecting %d and %d, got %d and %d", 1<<16, 1<<15, conn.br.Size(), conn.bw.Size())
+	}
+
+	c2.Close()
+	conn.Close()
+	conn.wg.Wait()
+}
+
+func BenchmarkAcquireConn(b *testing.B) {
+	s := &Server{}
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		c1, c2 := net.Pipe()
+
+		conn := s.acquireConn(c1, context.Background(), nil)
+
+		c2.Close()
+		conn.Close()
+		conn.c.Close()
+		conn.wg.Wait()
+
+		releaseConn(conn)
+	}
+}
+
+func TestCloseWritesQueued(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	conn := acquireConn(c1)
+
+	// the peer isn't reading yet, so the frames stay queued
+	payload := make([]byte, 4096)
+	for i := 0; i < 8; i++ {
+		conn.Write(payload)
+	}
+
+	conn.CloseDetail(StatusGoAway, "bye")
+
+	c2.SetReadDeadline(time.Now().Add(time.Second * 5))
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	n := 0
+	for {
+		fr.Reset()
+
+		if _, err := fr.ReadFrom(c2); err != nil {
+			t.Fatalf("Expecting the close frame after %d frames: %v", n, err)
+		}
+
+		if fr.IsClose() {
+			break
+		}
+
+		n++
+	}
+
+	if n != 8 {
+		t.Fatalf("Expecting 8 frames before the close frame, got %d", n)
+	}
+
+	if fr.Status() != StatusGoAway {
+		t.Fatalf("Expecting status %d, got %d", StatusGoAway, fr.Status())
+	}
+
+	c2.Close()
+	conn.wg.Wait()
+}
+
+func TestReleasedConn(t *testing.T) {
+	s := &Server{}
+
+	c1, c2 := net.Pipe()
+
+	conn := s.acquireConn(c1, context.Background(), nil)
+
+	done := make(chan struct{})
+	go func() {
+		s.serveConn(conn)
+		close(done)
+	}()
+
+	c2.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	// the handle outlives the connection
+	if conn.RemoteAddr() == nil || len(conn.LogFields()) == 0 {
+		t.Fatal("Expecting the addresses of the released connection")
+	}
+
+	if _, err := conn.WriteRaw([]byte{0x81, 0}); err != ErrConnClosed {
+		t.Fatalf("Expecting ErrConnClosed, got %v", err)
+	}
+
+	if _, err := conn.WriteVectored(false, []byte("Hello")); err != ErrConnClosed {
+		t.Fatalf("Expecting ErrConnClosed, got %v", err)
+	}
+
+	if _, err := conn.WriteSync([]byte("Hello")); err != ErrConnClosed {
+		t.Fatalf("Expecting ErrConnClosed, got %v", err)
+	}
+
+	if err := conn.Ping(nil); err != ErrConnClosed {
+		t.Fatalf("Expecting ErrConnClosed, got %v", err)
+	}
+}
+
+func TestHandlePanic(t *testing.T) {
+	ws := Server{}
+
+	panics := make(chan string, 1)
+	ws.HandlePanic(func(c *Conn, v interface{}, stack []byte) {
+		if len(stack) == 0 {
+			t.Error("Expecting the stack trace")
+		}
+
+		panics <- fmt.Sprint(v)
+	})
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		if string(data) == "boom" {
+			panic("boom")
+		}
+
+		c.Write(data)
+	})
+
+	errCh := make(chan error, 1)
+	ws.HandleClose(func(c *Conn, err error) {
+		errCh <- err
+	})
+
+	ln := serveInmemory(t, &ws)
+	conn := openConn(t, ln)
+	io.WriteString(conn, "boom")
+
+	select {
+	case v := <-panics:
+		if v != "boom" {
+			t.Fatalf("Expecting boom, got %q", v)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsClose() || fr.Status() != StatusUnexpected {
+		t.Fatalf("Expecting a close frame with StatusUnexpected, got %s", fr)
+	}
+
+	select {
+	case err := <-errCh:
+		if werr, ok := err.(Error); !ok || werr.Status != StatusUnexpected {
+			t.Fatalf("Expecting StatusUnexpected, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	conn.c.Close()
+
+	// the server keeps serving the other connections
+	conn = openConn(t, ln)
+	io.WriteString(conn, "Hello")
+
+	fr.Reset()
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(fr.Payload()); s != "Hello" {
+		t.Fatalf("Expecting Hello, got %q", s)
+	}
+
+	conn.Close()
+}
+
+func TestSetMaxPayloadSize(t *testing.T) {
+	ws := Server{}
+
+	ws.HandleOpen(func(c *Conn) {
+		c.SetMaxPayloadSize(8)
+	})
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		if string(data) == "login" {
+			c.SetMaxPayloadSize(64)
+		}
+
+		c.Write(data)
+	})
+
+	errCh := make(chan error, 1)
+	ws.HandleClose(func(c *Conn, err error) {
+		errCh <- err
+	})
+
+	ln := serveInmemory(t, &ws)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	big := strings.Repeat("x", 32)
+
+	conn := openConn(t, ln)
+
+	for _, msg := range []string{"login", big} {
+		io.WriteString(conn, msg)
+
+		fr.Reset()
+		if _, err := conn.ReadFrame(fr); err != nil {
+			t.Fatal(err)
+		}
+
+		if s := string(fr.Payload()); s != msg {
+			t.Fatalf("Expecting %q, got %q", msg, s)
+		}
+	}
+
+	conn.Close()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	// the limit set by the OpenHandler applies from the first frame
+	conn = openConn(t, ln)
+	io.WriteString(conn, big)
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, errLenTooBig) {
+			t.Fatalf("Expecting %v, got %v", errLenTooBig, err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	conn.c.Close()
+}
+
+// discardConn discards the data written, counting the writes.
+type discardConn struct {
+	net.Conn
+	writes int
+}
+
+func (dc *discardConn) Write(b []byte) (int, error) {
+	dc.writes++
+	return len(b), nil
+}
+
+func (dc *discardConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	const frames = 32
+
+	payload := []byte("small chat message")
+
+	queue := func(c *Conn) {
+		for i := 0; i < frames; i++ {
+			fr := AcquireFrame()
+			fr.SetText()
+			fr.SetFin()
+			fr.SetPayload(payload)
+
+			c.output <- fr
+		}
+	}
+
+	b.Run("PerFrame", func(b *testing.B) {
+		dc := &discardConn{}
+
+		c := &Conn{}
+		c.reset(dc)
+
+		for i := 0; i < b.N; i++ {
+			queue(c)
+
+			for len(c.output) > 0 {
+				fr := <-c.output
+				c.writeFrameDeadline(fr, time.Time{})
+				ReleaseFrame(fr)
+			}
+		}
+
+		b.ReportMetric(float64(dc.writes)/float64(b.N), "writes/op")
+	})
+
+	b.Run("Batched", func(b *testing.B) {
+		dc := &discardConn{}
+
+		c := &Conn{}
+		c.reset(dc)
+
+		for i := 0; i < b.N; i++ {
+			queue(c)
+
+			for len(c.output) > 0 {
+				c.writeBatch(<-c.output)
+			}
+		}
+
+		b.ReportMetric(float64(dc.writes)/float64(b.N), "writes/op")
+	})
+}
+
+func TestTCPConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if tcpConn(c) != c {
+		t.Fatal("Expecting the TCP connection")
+	}
+
+	if tcpConn(tls.Client(c, &tls.Config{})) != c {
+		t.Fatal("Expecting the TCP connection underlying the TLS connection")
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	if tcpConn(c1) != nil {
+		t.Fatal("Expecting no TCP connection")
+	}
+
+	// no-op for the connections that aren't TCP
+	setKeepAlive(c1, time.Second)
+	setKeepAlive(c, time.Second)
+
+	setNoDelay(c1, false)
+	setNoDelay(c, false)
+}
+
+func TestReadPressure(t *testing.T) {
+	ws := Server{
+		ReadBufferFrames: DefaultBufferFrames,
+	}
+
+	connCh := make(chan *Conn, 1)
+	ws.HandleOpen(func(c *Conn) {
+		connCh <- c
+	})
+
+	msgCh := make(chan string, 1)
+	release := make(chan struct{})
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		switch string(data) {
+		case "block":
+			<-release
+		case "x":
+		default:
+			msgCh <- string(data)
+		}
+	})
+
+	ln := serveInmemory(t, &ws)
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+
+		deadline := time.Now().Add(time.Second * 5)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s", what)
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	conn := openConn(t, ln)
+	c := <-connCh
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetText()
+	fr.SetPayload([]byte("Hello"))
+	conn.WriteFrame(fr)
+
+	waitFor("the pending bytes", func() bool {
+		return c.PendingReadBytes() == 5
+	})
+
+	fr.Reset()
+	fr.SetContinuation()
+	fr.SetFin()
+	fr.SetPayload([]byte(" world"))
+	conn.WriteFrame(fr)
+
+	select {
+	case msg := <-msgCh:
+		if msg != "Hello world" {
+			t.Fatalf("Expecting %q, got %q", "Hello world", msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	if n := c.PendingReadBytes(); n != 0 {
+		t.Fatalf("Expecting no pending bytes, got %d", n)
+	}
+
+	if c.ReadBlocked() {
+		t.Fatal("Expecting the read not to be blocked")
+	}
+
+	io.WriteString(conn, "block")
+	for i := 0; i <= DefaultBufferFrames; i++ {
+		io.WriteString(conn, "x")
+	}
+
+	waitFor("the read to be blocked", c.ReadBlocked)
+
+	close(release)
+
+	waitFor("the read to be unblocked", func() bool {
+		return !c.ReadBlocked()
+	})
+
+	conn.c.Close()
+}
+
+func TestReadBufferBytes(t *testing.T) {
+	s := &Server{
+		ReadBufferBytes: 10,
+	}
+
+	conns := make(chan *Conn, 1)
+	s.HandleOpen(func(c *Conn) {
+		conns <- c
+	})
+
+	release := make(chan struct{})
+	received := make(chan string, 8)
+	s.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		if string(data) == "block" {
+			<-release
+		}
+
+		received <- string(data)
+	})
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	go s.ServeConn(c1, context.Background())
+
+	c := <-conns
+
+	// the handler blocks on the first message, so the rest are read ahead
+	writeFrame(t, rawConn{c2}, CodeText, true, "block")
+	for i := 0; i < 2; i++ {
+		writeFrame(t, rawConn{c2}, CodeText, true, "12345678")
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for !c.ReadBlocked() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the read to be blocked")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	// the limit was reached, so the next frame isn't read
+	sent := make(chan struct{})
+	go func() {
+		writeFrame(t, rawConn{c2}, CodeText, true, "last")
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("Expecting the frame not to be read")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	close(release)
+
+	for _, expected := range []string{"block", "12345678", "12345678", "last"} {
+		select {
+		case msg := <-received:
+			if msg != expected {
+				t.Fatalf("Expecting %q, got %q", expected, msg)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+
+	if c.ReadBlocked() {
+		t.Fatal("Expecting the read not to be blocked")
+	}
+
+	<-sent
+}
+
+func TestWriteSync(t *testing.T) {
+	s := &Server{}
+	s.HandleError(func(c *Conn, err error) {})
+
+	c1, c2 := net.Pipe()
+
+	conn := s.acquireConn(c1, context.Background(), nil)
+	conn.WriteTimeout = time.Millisecond * 50
+
+	done := make(chan struct{})
+	go func() {
+		s.serveConn(conn)
+		close(done)
+	}()
+
+	// nobody reads from c2
+	_, err := conn.WriteSync([]byte("Hello"))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Expecting a timeout error, got %v", err)
+	}
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	readCh := make(chan error, 1)
+	go func() {
+		_, err := fr.ReadFrom(c2)
+		readCh <- err
+	}()
+
+	// the connection is still usable
+	n, err := conn.WriteSync([]byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 5 {
+		t.Fatalf("Expecting 5 bytes written, got %d", n)
+	}
+
+	if err := <-readCh; err != nil {
+		t.Fatal(err)
+	}
+
+	if string(fr.Payload()) != "world" {
+		t.Fatalf("Expecting world, got %s", fr.Payload())
+	}
+
+	c2.Close()
+	conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestMaxFragments(t *testing.T) {
+	ws := Server{}
+
+	ws.HandleOpen(func(c *Conn) {
+		c.MaxFragments = 3
+	})
+
+	ch := make(chan string, 1)
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		ch <- string(data)
+	})
+
+	conn := dialServer(t, &ws)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	writeFragments := func(n int) {
+		for i := 0; i < n; i++ {
+			fr.Reset()
+			if i == 0 {
+				fr.SetText()
+			} else {
+				fr.SetContinuation()
+			}
+
+			if i == n-1 {
+				fr.SetFin()
+			}
+
+			fr.SetPayload([]byte("a"))
+
+			if _, err := conn.WriteFrame(fr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// the counter is reset for every message
+	for i := 0; i < 2; i++ {
+		writeFragments(3)
+
+		select {
+		case data := <-ch:
+			if data != "aaa" {
+				t.Fatalf("Expecting aaa, got %q", data)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+
+	writeFragments(4)
+
+	fr.Reset()
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsClose() || fr.Status() != StatusPolicyViolation {
+		t.Fatalf("Expecting a close frame with StatusPolicyViolation, got %s", fr)
+	}
+
+	select {
+	case data := <-ch:
+		t.Fatalf("Unexpected message %q", data)
+	default:
+	}
+
+	conn.c.Close()
+}
+
+func TestPingPong(t *testing.T) {
+	s := &Server{}
+
+	c1, c2 := net.Pipe()
+
+	conn := s.acquireConn(c1, context.Background(), nil)
+
+	if err := conn.Ping(make([]byte, maxControlPayloadSize+1)); err != errLenTooBig {
+		t.Fatalf("Expecting errLenTooBig, got %v", err)
+	}
+
+	if err := conn.Pong(make([]byte, maxControlPayloadSize+1)); err != errLenTooBig {
+		t.Fatalf("Expecting errLenTooBig, got %v", err)
+	}
+
+	if err := conn.Ping([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Pong([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := fr.ReadFrom(c2); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsPing() || string(fr.Payload()) != "ping" {
+		t.Fatalf("Expecting a ping frame, got %s", fr)
+	}
+
+	fr.Reset()
+	if _, err := fr.ReadFrom(c2); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsPong() || string(fr.Payload()) != "pong" {
+		t.Fatalf("Expecting a pong frame, got %s", fr)
+	}
+
+	c2.Close()
+	conn.Close()
+	conn.wg.Wait()
+
+	if err := conn.Ping([]byte("ping")); err != ErrConnClosed {
+		t.Fatalf("Expecting ErrConnClosed, got %v", err)
+	}
+
+	if err := conn.Pong([]byte("pong")); err != ErrConnClosed {
+		t.Fatalf("Expecting ErrConnClosed, got %v", err)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	s := &Server{}
+
+	s.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		c.Write(data)
+	})
+
+	c1, c2 := net.Pipe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.ServeConn(c1, ctx)
+		close(done)
+	}()
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	writeFrame(t, rawConn{c2}, CodeText, true, "Hello")
+
+	fr.Reset()
+	if _, err := fr.ReadFrom(c2); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsText() || string(fr.Payload()) != "Hello" {
+		t.Fatalf("Expecting Hello, got %s", fr)
+	}
+
+	// cancelling the context closes the connection
+	cancel()
+
+	fr.Reset()
+	if _, err := fr.ReadFrom(c2); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsClose() {
+		t.Fatalf("Expecting a close frame, got %s", fr)
+	}
+
+	c2.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestInlineReads(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		close func(s *Server, c2 net.Conn, cancel context.CancelFunc)
+		// status is zero if the connection is closed without error.
+		status StatusCode
+		err    error
+	}{
+		{"peer", func(s *Server, c2 net.Conn, cancel context.CancelFunc) {
+			fr := AcquireFrame()
+			defer ReleaseFrame(fr)
+
+			fr.SetClose()
+			fr.SetStatus(StatusProtocolError)
+			fr.SetFin()
+			fr.Mask()
+			fr.WriteTo(c2)
+		}, StatusProtocolError, nil},
+		{"local", func(s *Server, c2 net.Conn, cancel context.CancelFunc) {
+			writeFrame(t, rawConn{c2}, CodeText, true, "close")
+		}, 0, nil},
+		{"context", func(s *Server, c2 net.Conn, cancel context.CancelFunc) {
+			cancel()
+		}, StatusGoAway, context.Canceled},
+		{"replaced context", func(s *Server, c2 net.Conn, cancel context.CancelFunc) {
+			writeFrame(t, rawConn{c2}, CodeText, true, "context")
+		}, StatusGoAway, context.Canceled},
+		{"shutdown", func(s *Server, c2 net.Conn, cancel context.CancelFunc) {
+			go s.Shutdown(context.Background(), 0, "")
+		}, StatusGoAway, ErrServerClosed},
+		{"idle", func(s *Server, c2 net.Conn, cancel context.CancelFunc) {}, StatusGoAway, ErrIdleTimeout},
+	} {
+		s := &Server{
+			IdleTimeout: time.Millisecond * 300,
+		}
+
+		s.HandleData(func(c *Conn, isBinary bool, data []byte) {
+			switch string(data) {
+			case "close":
+				c.Close()
+			case "context":
+				ctx, cancel := context.WithCancel(c.Context())
+				c.WithContext(ctx)
+				cancel()
+			default:
+				c.Write(data)
+			}
+		})
+
+		errCh := make(chan error, 1)
+		s.HandleClose(func(c *Conn, err error) {
+			errCh <- err
+		})
+
+		c1, c2 := net.Pipe()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		done := make(chan struct{})
+		go func() {
+			s.ServeConn(c1, ctx)
+			close(done)
+		}()
+
+		writeFrame(t, rawConn{c2}, CodeText, true, "Hello")
+
+		fr := AcquireFrame()
+
+		if _, err := fr.ReadFrom(c2); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		if string(fr.Payload()) != "Hello" {
+			t.Fatalf("%s: expecting Hello, got %s", tc.name, fr)
+		}
+
+		tc.close(s, c2, cancel)
+
+		// the server closing the connection waits for the peer's reply
+		if tc.name != "peer" {
+			fr.Reset()
+			if _, err := fr.ReadFrom(c2); err != nil {
+				t.Fatalf("%s: %s", tc.name, err)
+			}
+
+			if !fr.IsClose() {
+				t.Fatalf("%s: expecting a close frame, got %s", tc.name, fr)
+			}
+
+			// the close reply unblocks the read
+			fr.Mask()
+			fr.WriteTo(c2)
+		}
+
+		ReleaseFrame(fr)
+
+		go io.Copy(io.Discard, c2)
+
+		select {
+		case err := <-errCh:
+			var status StatusCode
+			if e, ok := err.(Error); ok {
+				status = e.Status
+			}
+
+			if status != tc.status || (tc.err != nil && !errors.Is(err, tc.err)) {
+				t.Fatalf("%s: unexpected close error %v", tc.name, err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("%s: timeout", tc.name)
+		}
+
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("%s: timeout", tc.name)
+		}
+
+		cancel()
+		c2.Close()
+	}
+}
+
+func BenchmarkIdleConns(b *testing.B) {
+	for _, frames := range []int{DefaultBufferFrames, 0} {
+		name := "ReadAhead"
+		if frames == 0 {
+			name = "Inline"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			s := &Server{
+				ReadBufferFrames: frames,
+			}
+
+			var wg sync.WaitGroup
+
+			before := runtime.NumGoroutine()
+			peers := make([]net.Conn, 0, b.N)
+
+			for i := 0; i < b.N; i++ {
+				c1, c2 := net.Pipe()
+				peers = append(peers, c2)
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					s.ServeConn(c1, context.Background())
+				}()
+			}
+
+			// the goroutines serving the connections are started
+			time.Sleep(time.Millisecond * 100)
+
+			b.ReportMetric(float64(runtime.NumGoroutine()-before)/float64(b.N), "goroutines/conn")
+
+			for _, c := range peers {
+				c.Close()
+			}
+
+			wg.Wait()
+		})
+	}
+}
+
+func TestUserTypedValues(t *testing.T) {
+	c := &Conn{}
+
+	if _, ok := c.UserInt("id"); ok {
+		t.Fatal("Expecting no value")
+	}
+
+	c.SetUserInt("id", 42)
+	c.SetUserString("token", "secret")
+	c.SetUserValue("other", 42)
+
+	if v, ok := c.UserInt("id"); !ok || v != 42 {
+		t.Fatalf("Expecting 42, got %d", v)
+	}
+
+	if v, ok := c.UserString("token"); !ok || v != "secret" {
+		t.Fatalf("Expecting secret, got %q", v)
+	}
+
+	// the types must match, without panicking
+	if _, ok := c.UserString("id"); ok {
+		t.Fatal("Expecting the integer not to be returned as a string")
+	}
+
+	if _, ok := c.UserInt("other"); ok {
+		t.Fatal("Expecting the int not to be returned as an int64")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	ws := Server{}
+
+	opened := make(chan struct{}, 2)
+	ws.HandleOpen(func(c *Conn) {
+		opened <- struct{}{}
+	})
+
+	errCh := make(chan error, 2)
+	ws.HandleClose(func(c *Conn, err error) {
+		errCh <- err
+	})
+
+	ln := serveInmemory(t, &ws)
+
+	conns := []*Client{openConn(t, ln), openConn(t, ln)}
+	for range conns {
+		<-opened
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if err := ws.Shutdown(ctx, 0, "restarting"); err != nil {
+		t.Fatal(err)
+	}
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	for _, conn := range conns {
+		fr.Reset()
+		if _, err := conn.ReadFrame(fr); err != nil {
+			t.Fatal(err)
+		}
+
+		if !fr.IsClose() || fr.Status() != StatusGoAway || string(fr.Payload()) != "restarting" {
+			t.Fatalf("Expecting a close frame with StatusGoAway, got %s", fr)
+		}
+
+		err := <-errCh
+		if werr, ok := err.(Error); !ok || werr.Status != StatusGoAway || !errors.Is(err, ErrServerClosed) {
+			t.Fatalf("Expecting ErrServerClosed, got %v", err)
+		}
+
+		conn.c.Close()
+	}
+
+	// the new connections are rejected
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := MakeClient(c, "http://localhost/"); !errors.Is(err, ErrCannotUpgrade) {
+		t.Fatalf("Expecting ErrCannotUpgrade, got %v", err)
+	}
+
+	c.Close()
+}
+
+func TestServerRange(t *testing.T) {
+	ws := Server{}
+
+	opened := make(chan uint64, 4)
+	ws.HandleOpen(func(c *Conn) {
+		opened <- c.ID()
+	})
+
+	closed := make(chan uint64, 4)
+	ws.HandleClose(func(c *Conn, err error) {
+		closed <- c.ID()
+	})
+
+	ln := serveInmemory(t, &ws)
+
+	conns := make(map[uint64]*Client)
+	for i := 0; i < 3; i++ {
+		conn := openConn(t, ln)
+		conns[<-opened] = conn
+	}
+
+	count := func() (n int) {
+		ws.Range(func(c *Conn) bool {
+			if _, ok := conns[c.ID()]; !ok {
+				t.Errorf("Unexpected connection %d", c.ID())
+			}
+
+			n++
+			return true
+		})
+		return
+	}
+
+	if n := count(); n != 3 {
+		t.Fatalf("Expecting 3 connections, got %d", n)
+	}
+
+	n := 0
+	ws.Range(func(c *Conn) bool {
+		n++
+		return false
+	})
+
+	if n != 1 {
+		t.Fatalf("Expecting the iteration to stop, got %d calls", n)
+	}
+
+	// the connections can be opened while f runs
+	ws.Range(func(c *Conn) bool {
+		conn := openConn(t, ln)
+
+		select {
+		case id := <-opened:
+			conns[id] = conn
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout opening a connection within Range")
+		}
+
+		return false
+	})
+
+	if n := count(); n != 4 {
+		t.Fatalf("Expecting 4 connections, got %d", n)
+	}
+
+	// kick one of the connections
+	var kicked uint64
+	for id := range conns {
+		kicked = id
+		break
+	}
+
+	ws.Range(func(c *Conn) bool {
+		if c.ID() == kicked {
+			c.Close()
+			return false
+		}
+
+		return true
+	})
+
+	select {
+	case id := <-closed:
+		if id != kicked {
+			t.Fatalf("Expecting connection %d to be closed, got %d", kicked, id)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	// the connection is unregistered after the CloseHandler
+	deadline := time.Now().Add(time.Second * 5)
+	for count() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the connection to be unregistered")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, conn := range conns {
+		conn.c.Close()
+	}
+
+}
+
+func TestConnUptime(t *testing.T) {
+	c1, c2 := net.Pipe()
+
+	before := time.Now()
+	conn := acquireConn(c1)
+
+	if at := conn.CreatedAt(); at.Before(before) || at.After(time.Now()) {
+		t.Fatalf("Unexpected creation time %s", at)
+	}
+
+	time.Sleep(time.Millisecond * 10)
+
+	if d := conn.Uptime(); d < time.Millisecond*10 {
+		t.Fatalf("Expecting an uptime of at least 10ms, got %s", d)
+	}
+
+	c2.Close()
+	conn.Close()
+	conn.wg.Wait()
+}
+
+func TestMessageStream(t *testing.T) {
+	s := &Server{}
+
+	read := make(chan string, 1)
+	s.HandleOpen(func(c *Conn) {
+		ms := c.MessageStream(true)
+
+		go func() {
+			b, err := io.ReadAll(ms)
+			if err != nil {
+				read <- err.Error()
+				return
+			}
+
+			read <- string(b)
+
+			ms.Write([]byte("He"))
+			ms.Write([]byte("llo"))
+			ms.Close()
+		}()
+	})
+
+	s.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		c.Write(data)
+	})
+
+	c2 := servePipe(t, s)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	writeFrame(t, rawConn{c2}, CodeText, false, "Hel")
+	writeFrame(t, rawConn{c2}, CodeContinuation, true, "lo")
+
+	select {
+	case s := <-read:
+		if s != "Hello" {
+			t.Fatalf("Expecting Hello, got %q", s)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	expect := []struct {
+		code    Code
+		fin     bool
+		payload string
+	}{
+		{CodeBinary, false, "He"},
+		{CodeContinuation, false, "llo"},
+		{CodeContinuation, true, ""},
+	}
+
+	for _, e := range expect {
+		fr.Reset()
+		if _, err := fr.ReadFrom(c2); err != nil {
+			t.Fatal(err)
+		}
+
+		if fr.Code() != e.code || fr.IsFin() != e.fin || string(fr.Payload()) != e.payload {
+			t.Fatalf("Expecting %s %v %q, got %s", e.code, e.fin, e.payload, fr)
+		}
+	}
+
+	// the next message is delivered to the handlers
+	writeFrame(t, rawConn{c2}, CodeText, true, "World")
+
+	fr.Reset()
+	if _, err := fr.ReadFrom(c2); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsText() || string(fr.Payload()) != "World" {
+		t.Fatalf("Expecting World, got %s", fr)
+	}
+}
+
+func TestMessageStreamConnClosed(t *testing.T) {
+	s := &Server{}
+
+	streams := make(chan io.ReadWriteCloser, 1)
+	s.HandleOpen(func(c *Conn) {
+		streams <- c.MessageStream(false)
+	})
+
+	c1, c2 := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		s.ServeConn(c1, context.Background())
+		close(done)
+	}()
+
+	ms := <-streams
+
+	// no message is received before closing
+	c2.Close()
+
+	if _, err := ms.Read(make([]byte, 8)); err != ErrConnClosed {
+		t.Fatalf("Expecting %v, got %v", ErrConnClosed, err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestHandleTextBinary(t *testing.T) {
+	s := &Server{}
+
+	s.HandleText(func(c *Conn, data []byte) {
+		c.Write(append([]byte("text:"), data...))
+	})
+
+	s.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		c.Write(append([]byte("data:"), data...))
+	})
+
+	c2 := servePipe(t, s)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	// the BinaryHandler isn't set, so the binary messages go to the MessageHandler
+	for _, code := range []Code{CodeText, CodeBinary} {
+		writeFrame(t, rawConn{c2}, code, true, "Hello")
+
+		fr.Reset()
+		if _, err := fr.ReadFrom(c2); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := "data:Hello"
+		if code == CodeText {
+			expect = "text:Hello"
+		}
+
+		if string(fr.Payload()) != expect {
+			t.Fatalf("Expecting %q, got %q", expect, fr.Payload())
+		}
+	}
+}
+
+func TestSetDefaultMessageType(t *testing.T) {
+	s := &Server{}
+
+	s.HandleOpen(func(c *Conn) {
+		c.SetDefaultMessageType(true)
+	})
+
+	s.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		fmt.Fprintf(c, "echo:%s", data)
+	})
+
+	c2 := servePipe(t, s)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	writeFrame(t, rawConn{c2}, CodeText, true, "Hello")
+
+	fr.Reset()
+	if _, err := fr.ReadFrom(c2); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsBinary() || string(fr.Payload()) != "echo:Hello" {
+		t.Fatalf("Expecting a binary echo:Hello, got %s", fr)
+	}
+}
+
+func TestConnWriteTo(t *testing.T) {
+	s := &Server{}
+
+	type result struct {
+		n   int64
+		err error
+	}
+
+	pr, pw := io.Pipe()
+
+	ch := make(chan result, 1)
+	s.HandleOpen(func(c *Conn) {
+		go func() {
+			n, err := c.WriteTo(pw)
+			ch <- result{n, err}
+		}()
+
+		// the frames are read once WriteTo waits for the messages
+		for {
+			c.streamMu.Lock()
+			sr := c.stream
+			c.streamMu.Unlock()
+
+			if sr != nil {
+				break
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	s.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		t.Errorf("Unexpected message %q", data)
+	})
+
+	c1, c2 := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		s.ServeConn(c1, context.Background())
+		close(done)
+	}()
+
+	// the frames are handled as the messages are written into pw
+	read := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 11)
+		io.ReadFull(pr, b)
+		read <- b
+	}()
+
+	writeFrame(t, rawConn{c2}, CodeText, false, "Hel")
+	writeFrame(t, rawConn{c2}, CodeContinuation, true, "lo ")
+	writeFrame(t, rawConn{c2}, CodeBinary, true, "World")
+
+	if b := <-read; string(b) != "Hello World" {
+		t.Fatalf("Expecting Hello World, got %q", b)
+	}
+
+	// WriteTo returns once the connection is closed
+	c2.Close()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+
+		if r.n != 11 {
+			t.Fatalf("Expecting 11 bytes, got %d", r.n)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestConnMessages(t *testing.T) {
+	s := &Server{}
+
+	msgs := make(chan (<-chan Message), 1)
+	s.HandleOpen(func(c *Conn) {
+		msgs <- c.Messages()
+	})
+
+	s.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		t.Errorf("Unexpected message %q", data)
+	})
+
+	c1, c2 := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		s.ServeConn(c1, context.Background())
+		close(done)
+	}()
+
+	ch := <-msgs
+
+	expect := []Message{
+		{IsBinary: false, Data: []byte("Hello")},
+		{IsBinary: true, Data: []byte("World")},
+	}
+
+	for _, m := range expect {
+		code := CodeText
+		if m.IsBinary {
+			code = CodeBinary
+		}
+
+		writeFrame(t, rawConn{c2}, code, true, string(m.Data))
+
+		// the connection is not read until the message is received
+		select {
+		case got := <-ch:
+			if got.IsBinary != m.IsBinary || !bytes.Equal(got.Data, m.Data) {
+				t.Fatalf("Expecting %v %q, got %v %q", m.IsBinary, m.Data, got.IsBinary, got.Data)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+
+	c2.Close()
+
+	// the channel is closed with the connection
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("Expecting the channel to be closed")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	<-done
+}
+
+func TestCloseWithReason(t *testing.T) {
+	type reason struct {
+		Code      int    `json:"code"`
+		Message   string `json:"message"`
+		Retryable bool   `json:"retryable"`
+	}
+
+	s := &Server{}
+
+	errCh := make(chan error, 2)
+	s.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		errCh <- c.CloseWithReason(StatusGoAway, reason{
+			Message: strings.Repeat("a", 125),
+		})
+		errCh <- c.CloseWithReason(StatusGoAway, reason{
+			Code:      42,
+			Message:   "restarting",
+			Retryable: true,
+		})
+	})
+
+	conn := pipeClient(s)
+	defer conn.Close()
+
+	io.WriteString(conn, "Hello")
+
+	if err := <-errCh; err != errLenTooBig {
+		t.Fatalf("Expecting %v, got %v", errLenTooBig, err)
+	}
+
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := conn.ReadFrame(fr); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsClose() || fr.Status() != StatusGoAway {
+		t.Fatalf("Expecting a close frame with StatusGoAway, got %s", fr)
+	}
+
+	var r reason
+	if err := json.Unmarshal(fr.Payload(), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	if r != (reason{42, "restarting", true}) {
+		t.Fatalf("Unexpected reason %+v", r)
+	}
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	s := &Server{
+		WriteBufferFrames: 1,
+	}
+
+	errs := make(chan error, 1)
+	s.HandleOpen(func(c *Conn) {
+		go func() {
+			// the peer doesn't read, so the queue gets full
+			c.Write([]byte("Hello"))
+			c.Write([]byte("Hello"))
+
+			errs <- c.CloseWithTimeout(time.Millisecond * 100)
+		}()
+	})
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.ServeConn(c1, context.Background())
+		close(done)
+	}()
+
+	select {
+	case err := <-errs:
+		if err != ErrCloseTimeout {
+			t.Fatalf("Expecting ErrCloseTimeout, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	// the close frame is written if the peer reads
+	c1, c2 = net.Pipe()
+	defer c2.Close()
+
+	s.HandleOpen(func(c *Conn) {
+		go func() {
+			errs <- c.CloseWithTimeout(time.Second * 5)
+		}()
+	})
+
+	go s.ServeConn(c1, context.Background())
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if _, err := fr.ReadFrom(c2); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsClose() {
+		t.Fatalf("Expecting a close frame, got %s", fr)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleFrame(t *testing.T) {
+	s := &Server{}
+
+	payloads := make(chan []byte, 1)
+	s.HandleFrame(func(c *Conn, fr *Frame) {
+		fr.Unmask()
+		payloads <- fr.CopyPayload(nil)
+	})
+
+	c2 := servePipe(t, s)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	writeFrame(t, rawConn{c2}, CodeBinary, true, "Hello")
+
+	select {
+	case b := <-payloads:
+		if string(b) != "Hello" {
+			t.Fatalf("Expecting Hello, got %q", b)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestHandleFrameForward(t *testing.T) {
+	s := &Server{}
+
+	// fr is released once the handler returns, so a copy is written
+	s.HandleFrame(func(c *Conn, fr *Frame) {
+		fr.Unmask()
+		c.WriteFrame(fr.Clone())
+	})
+
+	c2 := servePipe(t, s)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	for i := 0; i < 4; i++ {
+		writeFrame(t, rawConn{c2}, CodeBinary, true, "Hello")
+
+		fr.Reset()
+
+		if _, err := fr.ReadFrom(c2); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(fr.Payload()) != "Hello" {
+			t.Fatalf("Expecting Hello, got %q", fr.Payload())
+		}
+	}
+}
+
+type frameMeta struct {
+	opcode uint8
+	length uint64
+	fin    bool
+	masked bool
+	rsv    uint8
+}
+
+func TestHandleFrameMeta(t *testing.T) {
+	s := &Server{}
+
+	metas := make(chan frameMeta, 3)
+	s.HandleFrameMeta(func(c *Conn, opcode uint8, length uint64, fin, masked bool, rsv uint8) {
+		metas <- frameMeta{opcode, length, fin, masked, rsv}
+	})
+
+	msgs := make(chan string, 1)
+	s.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		msgs <- string(data)
+	})
+
+	conn := pipeClient(s)
+	defer conn.Close()
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetText()
+	fr.SetPayload([]byte("Hel"))
+	conn.WriteFrame(fr)
+
+	fr.Reset()
+	fr.SetContinuation()
+	fr.SetFin()
+	fr.SetPayload([]byte("lo"))
+	conn.WriteFrame(fr)
+
+	// the frames are still handled
+	select {
+	case msg := <-msgs:
+		if msg != "Hello" {
+			t.Fatalf("Expecting Hello, got %q", msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	for _, expected := range []frameMeta{
+		{uint8(CodeText), 3, false, true, 0},
+		{uint8(CodeContinuation), 2, true, true, 0},
+	} {
+		if m := <-metas; m != expected {
+			t.Fatalf("Expecting %v, got %v", expected, m)
+		}
+	}
+}
+
+func TestHandleFrameMetaRaw(t *testing.T) {
+	s := &Server{}
+
+	metas := make(chan frameMeta, 1)
+	s.HandleFrameMeta(func(c *Conn, opcode uint8, length uint64, fin, masked bool, rsv uint8) {
+		metas <- frameMeta{opcode, length, fin, masked, rsv}
+	})
+
+	// the frames are observed before the FrameHandler
+	handled := make(chan frameMeta, 1)
+	s.HandleFrame(func(c *Conn, fr *Frame) {
+		select {
+		case m := <-metas:
+			handled <- m
+		default:
+			t.Error("The FrameMetaHandler must be called first")
+		}
+	})
+
+	conn := pipeClient(s)
+	defer conn.Close()
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetBinary()
+	fr.SetFin()
+	fr.SetRSV1()
+	fr.SetRSV3()
+	fr.SetPayload([]byte("Hello"))
+	conn.WriteFrame(fr)
+
+	expected := frameMeta{uint8(CodeBinary), 5, true, true, 5}
+
+	select {
+	case m := <-handled:
+		if m != expected {
+			t.Fatalf("Expecting %v, got %v", expected, m)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestHandleFrameRaw(t *testing.T) {
+	s := &Server{}
+
+	relayed := make(chan []byte, 1)
+	s.HandleFrame(func(c *Conn, fr *Frame) {
+		bf := bytes.NewBuffer(nil)
+		fr.WriteTo(bf)
+		relayed <- bf.Bytes()
+	})
+
+	c2 := servePipe(t, s)
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetText()
+	fr.SetFin()
+	fr.SetRSV1()
+	fr.SetRSV3()
+	fr.SetPayload([]byte("Hello"))
+	fr.Mask()
+
+	sent := bytes.NewBuffer(nil)
+	fr.WriteTo(sent)
+
+	if _, err := c2.Write(sent.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case b := <-relayed:
+		if !bytes.Equal(b, sent.Bytes()) {
+			t.Fatalf("Expecting %v, got %v", sent.Bytes(), b)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
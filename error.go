@@ -2,11 +2,34 @@ package websocket
 
 import "fmt"
 
+// Error is the error passed to the CloseHandler when the connection
+// is not closed cleanly.
+//
+// Status is the status sent by the peer in its close frame or
+// StatusAbnormalClosure if the connection was closed without receiving one.
 type Error struct {
 	Status StatusCode
 	Reason string
+
+	// err is the error that closed the connection, if any.
+	err error
 }
 
 func (e Error) Error() string {
 	return fmt.Sprintf("%s: %s", e.Status, e.Reason)
 }
+
+// Unwrap returns the error that closed the connection, like io.EOF
+// for a connection dropped without receiving a close frame.
+func (e Error) Unwrap() error {
+	return e.err
+}
+
+// abnormalClosure reports a connection closed by err without a close frame.
+func abnormalClosure(err error) Error {
+	return Error{
+		Status: StatusAbnormalClosure,
+		Reason: err.Error(),
+		err:    err,
+	}
+}
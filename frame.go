@@ -7,6 +7,7 @@ import (
 	"io"
 	"strconv"
 	"sync"
+	"sync/atomic"
 )
 
 // StatusCode is sent when closing a connection.
@@ -25,40 +26,71 @@ const (
 	StatusNotAcceptable = 1003
 	// StatusReserved when a reserved field have been used
 	StatusReserved = 1004
-	// StatusNotConsistent IDK
+	// StatusNoStatusReceived is reported when a close frame without status is received.
+	// It must not be sent in a close frame.
+	StatusNoStatusReceived = 1005
+	// StatusAbnormalClosure is reported when the connection is closed
+	// without receiving a close frame. It must not be sent in a close frame.
+	StatusAbnormalClosure = 1006
+	// StatusNotConsistent when the message data is not consistent with its type,
+	// like non UTF-8 data in a text message.
 	StatusNotConsistent = 1007
 	// StatusViolation a violation of the protocol happened
 	StatusViolation = 1008
 	// StatusTooBig payload bigger than expected
 	StatusTooBig = 1009
-	// StatuseExtensionsNeeded IDK
+	// StatuseExtensionsNeeded when the client expected the server to negotiate an extension.
 	StatuseExtensionsNeeded = 1010
-	// StatusUnexpected IDK
+	// StatusUnexpected when the server found an unexpected condition.
 	StatusUnexpected = 1011
+	// StatusTLSHandshake is reported when the TLS handshake failed.
+	// It must not be sent in a close frame.
+	StatusTLSHandshake = 1015
 )
 
+// The status codes using the names defined by RFC 6455.
+//
+// https://tools.ietf.org/html/rfc6455#section-7.4.1
+const (
+	StatusNormalClosure       = StatusNone
+	StatusGoingAway           = StatusGoAway
+	StatusUnsupportedData     = StatusNotAcceptable
+	StatusInvalidFramePayload = StatusNotConsistent
+	StatusPolicyViolation     = StatusViolation
+	StatusMessageTooBig       = StatusTooBig
+	StatusMandatoryExtension  = StatuseExtensionsNeeded
+	StatusInternalError       = StatusUnexpected
+)
+
+// String returns the name of the status as defined by the RFC.
 func (status StatusCode) String() string {
 	switch status {
 	case StatusNone:
-		return "None"
+		return "Normal Closure"
 	case StatusGoAway:
-		return "GoAway"
+		return "Going Away"
 	case StatusProtocolError:
-		return "ProtocolError"
+		return "Protocol Error"
 	case StatusNotAcceptable:
-		return "NotAcceptable"
+		return "Unsupported Data"
 	case StatusReserved:
 		return "Reserved"
+	case StatusNoStatusReceived:
+		return "No Status Received"
+	case StatusAbnormalClosure:
+		return "Abnormal Closure"
 	case StatusNotConsistent:
-		return "NotConsistent"
+		return "Invalid Frame Payload Data"
 	case StatusViolation:
-		return "Violation"
+		return "Policy Violation"
 	case StatusTooBig:
-		return "TooBig"
+		return "Message Too Big"
 	case StatuseExtensionsNeeded:
-		return "ExtensionsNeeded"
+		return "Mandatory Extension"
 	case StatusUnexpected:
-		return "Unexpected"
+		return "Internal Error"
+	case StatusTLSHandshake:
+		return "TLS Handshake"
 	}
 
 	return strconv.FormatInt(int64(status), 10)
@@ -132,6 +164,19 @@ func (fr *Frame) CopyTo(fr2 *Frame) {
 	fr2.op = append(fr2.op[:0], fr.op...)
 	fr2.mask = append(fr2.mask[:0], fr.mask...)
 	fr2.b = append(fr2.b[:0], fr.b...)
+	fr2.statusDefined = fr.statusDefined
+}
+
+// Clone returns a copy of fr acquired from the pool.
+//
+// The frames are released once written, so a frame can't be written into
+// many connections. Clone allows to build the frame once and write a copy
+// of it into each connection when broadcasting.
+func (fr *Frame) Clone() *Frame {
+	fr2 := AcquireFrame()
+	fr.CopyTo(fr2)
+
+	return fr2
 }
 
 // String returns a representation of Frame in a human-readable string format.
@@ -160,7 +205,7 @@ var framePool = sync.Pool{
 	New: func() interface{} {
 		fr := &Frame{
 			max:  DefaultPayloadSize,
-			op:   make([]byte, opSize),
+			op:   make([]byte, opSize, opSize+maskSize+smallFrameSize),
 			mask: make([]byte, maskSize),
 			b:    make([]byte, 0, 128),
 		}
@@ -171,12 +216,24 @@ var framePool = sync.Pool{
 
 // AcquireFrame gets Frame from the global pool.
 func AcquireFrame() *Frame {
-	return framePool.Get().(*Frame)
+	fr := framePool.Get().(*Frame)
+	if atomic.LoadInt32(&framePoolDebug) == 1 {
+		trackAcquire(fr)
+	}
+
+	return fr
 }
 
 // ReleaseFrame puts fr Frame into the global pool.
 func ReleaseFrame(fr *Frame) {
 	fr.Reset()
+	// the limit set by SetPayloadSize must not leak to the next user
+	fr.max = DefaultPayloadSize
+
+	if atomic.LoadInt32(&framePoolDebug) == 1 {
+		trackRelease(fr)
+	}
+
 	framePool.Put(fr)
 }
 
@@ -187,6 +244,10 @@ func (fr *Frame) resetPayload() {
 const (
 	maskSize = 4
 	opSize   = 10
+
+	// smallFrameSize is the biggest frame (header included)
+	// WriteTo writes using a single call.
+	smallFrameSize = 128
 )
 
 func (fr *Frame) resetHeader() {
@@ -196,6 +257,10 @@ func (fr *Frame) resetHeader() {
 }
 
 // Reset resets all Frame values to the default.
+//
+// The opcode, the FIN and RSV bits, the mask, the status and the payload
+// are cleared, so a reset frame can be reused like a new one.
+// Only the limit set by SetPayloadSize is kept, ReleaseFrame restores it.
 func (fr *Frame) Reset() {
 	fr.resetHeader()
 	fr.resetPayload()
@@ -226,6 +291,16 @@ func (fr *Frame) Code() Code {
 	return Code(fr.op[0] & 15)
 }
 
+// IsText returns true if Code is CodeText.
+func (fr *Frame) IsText() bool {
+	return fr.Code() == CodeText
+}
+
+// IsBinary returns true if Code is CodeBinary.
+func (fr *Frame) IsBinary() bool {
+	return fr.Code() == CodeBinary
+}
+
 // IsPing returns true if Code is CodePing.
 func (fr *Frame) IsPing() bool {
 	return fr.Code() == CodePing
@@ -272,6 +347,33 @@ func (fr *Frame) Len() (length uint64) {
 	return
 }
 
+// HeaderLen returns the number of bytes the frame header
+// takes on the wire, based on the payload length and the mask bit.
+func (fr *Frame) HeaderLen() int {
+	n := 2
+
+	switch s := len(fr.b); {
+	case s > 65535:
+		n += 8
+	case s > 125:
+		n += 2
+	}
+
+	if fr.IsMasked() {
+		n += maskSize
+	}
+
+	return n
+}
+
+// WireLen returns the number of bytes the frame takes on the wire,
+// that is, the header and the payload.
+//
+// Len returns the payload length set in the header instead.
+func (fr *Frame) WireLen() int {
+	return fr.HeaderLen() + len(fr.b)
+}
+
 // MaskKey returns mask key.
 //
 // Returns zero-padded if doesn't have a mask
@@ -288,6 +390,14 @@ func (fr *Frame) Payload() []byte {
 	return fr.b
 }
 
+// CopyPayload copies the payload into dst, reusing its capacity, and returns it.
+//
+// The payload points into the frame, which is reused once released,
+// so CopyPayload allows retaining it. dst can be nil.
+func (fr *Frame) CopyPayload(dst []byte) []byte {
+	return append(dst[:0], fr.Payload()...)
+}
+
 // PayloadLen returns the actual payload length
 func (fr *Frame) PayloadLen() int {
 	return len(fr.b)
@@ -340,7 +450,7 @@ func (fr *Frame) SetText() {
 	fr.SetCode(CodeText)
 }
 
-// SetBinary sets CodeText in Code field.
+// SetBinary sets CodeBinary in Code field.
 func (fr *Frame) SetBinary() {
 	fr.SetCode(CodeBinary)
 }
@@ -393,11 +503,40 @@ func (fr *Frame) SetPayload(b []byte) {
 	fr.b = append(fr.b[:n], b...)
 }
 
+// AppendPayload appends b to the frame's payload, reusing the payload buffer.
+//
+// If a payload size is set using SetPayloadSize, only the bytes
+// fitting in that size are appended. AppendPayload returns
+// the number of bytes appended.
+func (fr *Frame) AppendPayload(b []byte) int {
+	if fr.max > 0 {
+		n := uint64(len(fr.Payload()))
+		if n >= fr.max {
+			return 0
+		}
+
+		if uint64(len(b)) > fr.max-n {
+			b = b[:fr.max-n]
+		}
+	}
+
+	if fr.IsClose() && len(fr.b) < 2 {
+		fr.b = append(fr.b[:0], 0, 0)
+	}
+
+	fr.b = append(fr.b, b...)
+
+	return len(b)
+}
+
 // setPayloadLen returns the number of bytes the header will use
 // for sending out the payload's length.
 func (fr *Frame) setPayloadLen() (s int) {
-	n := len(fr.b)
+	return fr.setPayloadLenTo(len(fr.b))
+}
 
+// setPayloadLenTo is like setPayloadLen but using n as the payload's length.
+func (fr *Frame) setPayloadLenTo(n int) (s int) {
 	switch {
 	case n > 65535:
 		s = 8
@@ -420,13 +559,42 @@ func (fr *Frame) setLength(n int) {
 }
 
 // Mask performs the masking of the current payload
+// using a random mask key.
 func (fr *Frame) Mask() {
+	var key [4]byte
+	readMask(key[:])
+
+	fr.MaskWithKey(key)
+}
+
+// MaskWithKey performs the masking of the current payload using key.
+//
+// It allows reproducing captured frames or writing deterministic tests,
+// the frames sent to a server must use unpredictable keys otherwise.
+func (fr *Frame) MaskWithKey(key [4]byte) {
+	fr.SetMask(key[:])
+
+	if len(fr.b) != 0 {
+		mask(fr.mask, fr.b)
+	}
+}
+
+// maskFrom performs the masking of the current payload
+// reading the mask key from r.
+//
+// If the key can't be read the frame is left unmasked.
+func (fr *Frame) maskFrom(r io.Reader) error {
+	if _, err := io.ReadFull(r, fr.mask[:4]); err != nil {
+		return err
+	}
+
 	fr.op[1] |= maskBit
 
-	readMask(fr.mask)
 	if len(fr.b) != 0 {
 		mask(fr.mask, fr.b)
 	}
+
+	return nil
 }
 
 // Unmask performs the unmasking of the current payload
@@ -440,10 +608,33 @@ func (fr *Frame) Unmask() {
 }
 
 // WriteTo writes the frame into wr.
+//
+// Small frames are written using a single call to wr.Write.
 func (fr *Frame) WriteTo(wr io.Writer) (n int64, err error) {
-	var ni int
 	s := fr.setPayloadLen()
 
+	if size := fr.WireLen(); size <= smallFrameSize && cap(fr.op) >= size {
+		// the spare capacity of op holds the header and the payload,
+		// so the length of op isn't modified.
+		b := fr.op[:s+2]
+		if fr.IsMasked() {
+			b = append(b, fr.mask...)
+		}
+		b = append(b, fr.b...)
+
+		ni, err := wr.Write(b)
+
+		return int64(ni), err
+	}
+
+	return fr.writeParts(wr, s)
+}
+
+// writeParts writes the header, the mask and the payload of the frame
+// into wr using different calls. s is the value returned by setPayloadLen.
+func (fr *Frame) writeParts(wr io.Writer, s int) (n int64, err error) {
+	var ni int
+
 	// +2 because we must include the
 	// first two bytes (stuff + opcode + mask + payload len)
 	ni, err = wr.Write(fr.op[:s+2])
@@ -519,26 +710,44 @@ var (
 )
 
 // ReadFrom fills fr reading from rd.
+//
+// The header and the declared payload length are read completely,
+// however rd delivers them. io.EOF is only returned when rd ends
+// before the first byte of the frame.
 func (fr *Frame) ReadFrom(rd io.Reader) (int64, error) {
 	return fr.readFrom(rd)
 }
 
 var (
-	errReadingHeader = errors.New("error reading frame header")
-	errReadingLen    = errors.New("error reading b length")
-	errReadingMask   = errors.New("error reading mask")
-	errLenTooBig     = errors.New("message length is bigger than expected")
-	errStatusLen     = errors.New("length of the status must be = 2")
+	errReadingHeader    = errors.New("error reading frame header")
+	errReadingLen       = errors.New("error reading b length")
+	errReadingMask      = errors.New("error reading mask")
+	errLenTooBig        = errors.New("message length is bigger than expected")
+	errStatusLen        = errors.New("length of the status must be = 2")
+	errTooManyFragments = errors.New("message split into too many frames")
 )
 
 const limitLen = 1 << 32
 
 func (fr *Frame) readFrom(r io.Reader) (int64, error) {
+	n, err := fr.readHeader(r)
+	if err == nil {
+		var m int64
+		m, err = fr.readPayload(r)
+		n += m
+	}
+
+	return n, err
+}
+
+// readHeader reads the frame header, including the payload length and the mask.
+func (fr *Frame) readHeader(r io.Reader) (int64, error) {
 	var err error
-	var n, m int
+	var n, m, total int
 
 	// read the first 2 bytes (stuff + opcode + maskbit + payload len)
 	n, err = io.ReadFull(r, fr.op[:2])
+	total += n
 	if err == io.ErrUnexpectedEOF {
 		err = errReadingHeader
 	}
@@ -549,36 +758,47 @@ func (fr *Frame) readFrom(r io.Reader) (int64, error) {
 
 		if m > 2 { // reading length
 			n, err = io.ReadFull(r, fr.op[2:m]) // start from 2 to fill in 2:m
-			if err == io.ErrUnexpectedEOF {
+			total += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				err = errReadingLen
 			}
 		}
 
 		if err == nil && fr.IsMasked() { // reading mask
 			n, err = io.ReadFull(r, fr.mask[:4])
-			if err == io.ErrUnexpectedEOF {
+			total += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				err = errReadingMask
 			}
 		}
+	}
+
+	return int64(total), err
+}
+
+// readPayload reads the payload of the frame whose header was read by readHeader.
+func (fr *Frame) readPayload(r io.Reader) (int64, error) {
+	var err error
+	var n int
+
+	if frameSize := fr.Len(); (fr.max > 0 && frameSize > fr.max) || frameSize > limitLen {
+		err = errLenTooBig
+	} else if frameSize > 0 { // read the payload
+		nn := int64(frameSize)
+		if nn < 0 {
+			panic("uint64 to int64 conversion gave a negative number")
+		}
+
+		if nn > 0 {
+			if rLen := nn - int64(cap(fr.b)); rLen > 0 {
+				fr.b = append(fr.b[:cap(fr.b)], make([]byte, rLen)...)
+			}
 
-		if err == nil {
-			// reading the payload
-			if frameSize := fr.Len(); (fr.max > 0 && frameSize > fr.max) || frameSize > limitLen {
-				err = errLenTooBig
-			} else if frameSize > 0 { // read the payload
-				nn := int64(frameSize)
-				if nn < 0 {
-					panic("uint64 to int64 conversion gave a negative number")
-				}
-
-				if nn > 0 {
-					if rLen := nn - int64(cap(fr.b)); rLen > 0 {
-						fr.b = append(fr.b[:cap(fr.b)], make([]byte, rLen)...)
-					}
-
-					fr.b = fr.b[:nn]
-					n, err = io.ReadFull(r, fr.b)
-				}
+			fr.b = fr.b[:nn]
+			n, err = io.ReadFull(r, fr.b)
+			// the header was already read, so the frame is truncated
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
 			}
 		}
 	}
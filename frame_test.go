@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"io"
 	"testing"
+	"testing/iotest"
 )
 
 var (
@@ -47,10 +48,13 @@ func TestReadHugeBufio(t *testing.T) {
 	)
 	fr := AcquireFrame()
 
-	_, err := fr.ReadFrom(reader)
+	n, err := fr.ReadFrom(reader)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if n != int64(len(hugePacket)) {
+		t.Fatalf("Expecting %d bytes read, got %d", len(hugePacket), n)
+	}
 	checkValues(fr, t, false, true, hugePacket[4:])
 
 	ReleaseFrame(fr)
@@ -80,6 +84,139 @@ func TestReadHugeStd(t *testing.T) {
 	ReleaseFrame(fr)
 }
 
+func TestReadOneByte(t *testing.T) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	masked := AcquireFrame()
+	masked.SetText()
+	masked.SetFin()
+	masked.SetPayload(hugePacket[4:])
+	masked.Mask()
+
+	bf := bytes.NewBuffer(nil)
+	masked.WriteTo(bf)
+	ReleaseFrame(masked)
+
+	for _, tc := range []struct {
+		packet, payload []byte
+	}{
+		{littlePacket, littlePacket[2:]},
+		{hugePacket, hugePacket[4:]},
+		{bf.Bytes(), hugePacket[4:]},
+	} {
+		packet := tc.packet
+		fr.Reset()
+
+		n, err := fr.ReadFrom(iotest.OneByteReader(bytes.NewReader(packet)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(packet)) {
+			t.Fatalf("Expecting %d bytes read, got %d", len(packet), n)
+		}
+
+		if fr.IsMasked() {
+			fr.Unmask()
+		}
+		checkValues(fr, t, false, true, tc.payload)
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	for i := 1; i < len(hugePacket); i++ {
+		fr.Reset()
+
+		_, err := fr.ReadFrom(iotest.OneByteReader(bytes.NewReader(hugePacket[:i])))
+		if err == nil || err == io.EOF {
+			t.Fatalf("%d bytes: expecting a truncation error, got %v", i, err)
+		}
+	}
+
+	fr.Reset()
+	if _, err := fr.ReadFrom(bytes.NewReader(nil)); err != io.EOF {
+		t.Fatalf("Expecting io.EOF, got %v", err)
+	}
+}
+
+func TestFrameReset(t *testing.T) {
+	big := make([]byte, 1<<16)
+
+	for _, tc := range []struct {
+		name string
+		set  func(fr *Frame)
+	}{
+		{"fin", (*Frame).SetFin},
+		{"rsv1", (*Frame).SetRSV1},
+		{"rsv2", (*Frame).SetRSV2},
+		{"rsv3", (*Frame).SetRSV3},
+		{"binary", (*Frame).SetBinary},
+		{"close", (*Frame).SetClose},
+		{"ping", (*Frame).SetPing},
+		{"mask", (*Frame).Mask},
+		{"status", func(fr *Frame) { fr.SetStatus(StatusGoAway) }},
+		{"payload", func(fr *Frame) { fr.SetPayload([]byte("Hello")) }},
+		{"length", func(fr *Frame) { fr.SetPayload(big) }},
+		{"all", func(fr *Frame) {
+			fr.SetFin()
+			fr.SetRSV1()
+			fr.SetRSV2()
+			fr.SetRSV3()
+			fr.SetClose()
+			fr.SetStatus(StatusGoAway)
+			fr.SetPayload(big)
+			fr.Mask()
+
+			bf := bytes.NewBuffer(nil)
+			fr.WriteTo(bf)
+		}},
+	} {
+		fr := AcquireFrame()
+
+		tc.set(fr)
+		fr.Reset()
+
+		if fr.IsFin() || fr.HasRSV1() || fr.HasRSV2() || fr.HasRSV3() {
+			t.Fatalf("%s: unexpected flags %08b", tc.name, fr.op[0])
+		}
+
+		if fr.Code() != CodeContinuation || fr.IsMasked() || fr.Len() != 0 {
+			t.Fatalf("%s: unexpected header %v", tc.name, fr.op)
+		}
+
+		if !bytes.Equal(fr.op, make([]byte, opSize)) || !bytes.Equal(fr.mask, make([]byte, maskSize)) {
+			t.Fatalf("%s: expecting a zeroed header, got %v and mask %v", tc.name, fr.op, fr.mask)
+		}
+
+		if len(fr.Payload()) != 0 || fr.statusDefined || fr.Status() != StatusNone {
+			t.Fatalf("%s: unexpected payload %v", tc.name, fr.Payload())
+		}
+
+		// the reused frame is written like a new one
+		fr2 := AcquireFrame()
+
+		for _, f := range []*Frame{fr, fr2} {
+			f.SetText()
+			f.SetFin()
+			f.SetPayload([]byte("Hello"))
+		}
+
+		b1, b2 := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+		fr.WriteTo(b1)
+		fr2.WriteTo(b2)
+
+		if !bytes.Equal(b1.Bytes(), b2.Bytes()) {
+			t.Fatalf("%s: expecting %v, got %v", tc.name, b2.Bytes(), b1.Bytes())
+		}
+
+		ReleaseFrame(fr)
+		ReleaseFrame(fr2)
+	}
+}
+
 func checkValues(fr *Frame, t *testing.T, c, fin bool, payload []byte) {
 	if fin && !fr.IsFin() {
 		t.Fatal("Is not fin")
@@ -99,6 +236,38 @@ func checkValues(fr *Frame, t *testing.T, c, fin bool, payload []byte) {
 	}
 }
 
+func TestFrameCodes(t *testing.T) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetFin()
+
+	setters := []struct {
+		set  func()
+		is   func() bool
+		code Code
+	}{
+		{fr.SetContinuation, fr.IsContinuation, CodeContinuation},
+		{fr.SetText, fr.IsText, CodeText},
+		{fr.SetBinary, fr.IsBinary, CodeBinary},
+		{fr.SetClose, fr.IsClose, CodeClose},
+		{fr.SetPing, fr.IsPing, CodePing},
+		{fr.SetPong, fr.IsPong, CodePong},
+	}
+
+	for _, s := range setters {
+		s.set()
+
+		if !s.is() || fr.Code() != s.code {
+			t.Fatalf("Expecting %s, got %s", s.code, fr.Code())
+		}
+
+		if !fr.IsFin() {
+			t.Fatalf("Setting %s dropped the FIN bit", s.code)
+		}
+	}
+}
+
 func BenchmarkRead(b *testing.B) {
 	b.ReportAllocs()
 
@@ -123,3 +292,284 @@ func BenchmarkRead(b *testing.B) {
 		ReleaseFrame(fr)
 	})
 }
+
+func TestStatusCodeString(t *testing.T) {
+	for _, tc := range []struct {
+		status StatusCode
+		expect string
+	}{
+		{StatusNormalClosure, "Normal Closure"},
+		{StatusGoingAway, "Going Away"},
+		{StatusProtocolError, "Protocol Error"},
+		{StatusUnsupportedData, "Unsupported Data"},
+		{StatusAbnormalClosure, "Abnormal Closure"},
+		{StatusInvalidFramePayload, "Invalid Frame Payload Data"},
+		{StatusPolicyViolation, "Policy Violation"},
+		{StatusMessageTooBig, "Message Too Big"},
+		{StatusMandatoryExtension, "Mandatory Extension"},
+		{StatusInternalError, "Internal Error"},
+		{4000, "4000"},
+	} {
+		if s := tc.status.String(); s != tc.expect {
+			t.Errorf("%d: expecting %q, got %q", uint16(tc.status), tc.expect, s)
+		}
+	}
+}
+
+func TestFrameClone(t *testing.T) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetClose()
+	fr.SetFin()
+	fr.SetStatus(StatusGoAway)
+	fr.SetPayload([]byte("bye"))
+
+	clone := fr.Clone()
+
+	if clone == fr {
+		t.Fatal("Expecting a different frame")
+	}
+
+	if !clone.IsClose() || !clone.IsFin() || clone.Status() != StatusGoAway {
+		t.Fatalf("Unexpected header: %s", clone)
+	}
+
+	if s := string(clone.Payload()); s != "bye" {
+		t.Fatalf("Expecting bye, got %q", s)
+	}
+
+	// releasing the clone must not affect the original frame
+	ReleaseFrame(clone)
+
+	if s := string(fr.Payload()); s != "bye" {
+		t.Fatalf("Expecting bye, got %q", s)
+	}
+}
+
+func TestFrameAppendPayload(t *testing.T) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetText()
+	fr.SetFin()
+	fr.SetPayloadSize(8)
+
+	if n := fr.AppendPayload([]byte("Hello")); n != 5 {
+		t.Fatalf("Expecting 5 bytes appended, got %d", n)
+	}
+
+	if n := fr.AppendPayload([]byte(" world")); n != 3 {
+		t.Fatalf("Expecting 3 bytes appended, got %d", n)
+	}
+
+	if n := fr.AppendPayload([]byte("!")); n != 0 {
+		t.Fatalf("Expecting 0 bytes appended, got %d", n)
+	}
+
+	if s := string(fr.Payload()); s != "Hello wo" {
+		t.Fatalf("Expecting %q, got %q", "Hello wo", s)
+	}
+
+	bf := bytes.NewBuffer(nil)
+	if _, err := fr.WriteTo(bf); err != nil {
+		t.Fatal(err)
+	}
+
+	fr2 := AcquireFrame()
+	defer ReleaseFrame(fr2)
+
+	if _, err := fr2.ReadFrom(bf); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(fr2.Payload()); s != "Hello wo" {
+		t.Fatalf("Expecting %q, got %q", "Hello wo", s)
+	}
+}
+
+func TestFrameMaskWithKey(t *testing.T) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetText()
+	fr.SetFin()
+	fr.SetPayload([]byte("Hello"))
+	fr.MaskWithKey([4]byte{0x37, 0xfa, 0x21, 0x3d})
+
+	bf := bytes.NewBuffer(nil)
+	if _, err := fr.WriteTo(bf); err != nil {
+		t.Fatal(err)
+	}
+
+	// https://tools.ietf.org/html/rfc6455#section-5.7
+	expect := []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+	if !bytes.Equal(bf.Bytes(), expect) {
+		t.Fatalf("Expecting %x, got %x", expect, bf.Bytes())
+	}
+
+	fr2 := AcquireFrame()
+	defer ReleaseFrame(fr2)
+
+	if _, err := fr2.ReadFrom(bf); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(fr2.MaskKey(), []byte{0x37, 0xfa, 0x21, 0x3d}) {
+		t.Fatalf("Unexpected mask key: %x", fr2.MaskKey())
+	}
+
+	fr2.Unmask()
+
+	if s := string(fr2.Payload()); s != "Hello" {
+		t.Fatalf("Expecting Hello, got %q", s)
+	}
+}
+
+func TestFrameHeaderLen(t *testing.T) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	for _, tc := range []struct {
+		size      int
+		masked    bool
+		headerLen int
+	}{
+		{0, false, 2},
+		{125, false, 2},
+		{126, false, 4},
+		{65535, false, 4},
+		{65536, false, 10},
+		{0, true, 6},
+		{126, true, 8},
+		{65536, true, 14},
+	} {
+		fr.Reset()
+		fr.SetBinary()
+		fr.SetFin()
+		fr.SetPayload(make([]byte, tc.size))
+		if tc.masked {
+			fr.Mask()
+		}
+
+		if n := fr.HeaderLen(); n != tc.headerLen {
+			t.Fatalf("%d bytes: expecting a header of %d bytes, got %d", tc.size, tc.headerLen, n)
+		}
+
+		bf := bytes.NewBuffer(nil)
+		if _, err := fr.WriteTo(bf); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := fr.WireLen(); n != bf.Len() {
+			t.Fatalf("%d bytes: expecting %d bytes on the wire, got %d", tc.size, bf.Len(), n)
+		}
+	}
+}
+
+type callsWriter struct {
+	bytes.Buffer
+	calls int
+}
+
+func (w *callsWriter) Write(b []byte) (int, error) {
+	w.calls++
+	return w.Buffer.Write(b)
+}
+
+func TestFrameWriteToSmall(t *testing.T) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	for _, size := range []int{0, 16, smallFrameSize - 6, smallFrameSize, 1024} {
+		for _, masked := range []bool{false, true} {
+			fr.Reset()
+			fr.SetText()
+			fr.SetFin()
+			fr.SetPayload(bytes.Repeat([]byte("a"), size))
+			if masked {
+				fr.Mask()
+			}
+
+			w := &callsWriter{}
+			n, err := fr.WriteTo(w)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if int(n) != fr.WireLen() || w.Len() != fr.WireLen() {
+				t.Fatalf("Expecting %d bytes, got %d (%d written)", fr.WireLen(), n, w.Len())
+			}
+
+			if fr.WireLen() <= smallFrameSize && w.calls != 1 {
+				t.Fatalf("Expecting 1 write for %d bytes, got %d", fr.WireLen(), w.calls)
+			}
+
+			expect := bytes.NewBuffer(nil)
+			fr.writeParts(expect, fr.setPayloadLen())
+
+			if !bytes.Equal(w.Bytes(), expect.Bytes()) {
+				t.Fatalf("Expecting %x, got %x", expect.Bytes(), w.Bytes())
+			}
+		}
+	}
+}
+
+func BenchmarkFrameWriteTo(b *testing.B) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetText()
+	fr.SetFin()
+	fr.SetPayload([]byte("0123456789abcdef"))
+
+	bw := bufio.NewWriter(io.Discard)
+
+	b.Run("Single", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(fr.WireLen()))
+
+		for i := 0; i < b.N; i++ {
+			fr.WriteTo(bw)
+		}
+	})
+
+	b.Run("Parts", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(fr.WireLen()))
+
+		for i := 0; i < b.N; i++ {
+			fr.writeParts(bw, fr.setPayloadLen())
+		}
+	})
+}
+
+func TestFrameCopyPayload(t *testing.T) {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetBinary()
+	fr.SetPayload([]byte("Hello"))
+
+	b := fr.CopyPayload(nil)
+
+	dst := make([]byte, 2, 16)
+	dst = fr.CopyPayload(dst)
+
+	// like when the frame is reused
+	fr.SetPayload([]byte("World"))
+
+	if string(b) != "Hello" || string(dst) != "Hello" {
+		t.Fatalf("Expecting Hello, got %q and %q", b, dst)
+	}
+
+	// the status of the close frames is not part of the payload
+	fr.Reset()
+	fr.SetClose()
+	fr.SetStatus(StatusNone)
+	fr.Write([]byte("bye"))
+
+	if s := string(fr.CopyPayload(nil)); s != "bye" {
+		t.Fatalf("Expecting bye, got %q", s)
+	}
+}
@@ -0,0 +1,135 @@
+package websocket
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// framePoolDebug is set atomically when the frames are tracked.
+var framePoolDebug int32
+
+// frameTracker holds the frames acquired while debugging the pool.
+var frameTracker = struct {
+	mu       sync.Mutex
+	acquired uint64
+	released uint64
+	// frames are the outstanding frames with the stack where they were acquired.
+	frames map[*Frame][]uintptr
+}{}
+
+// SetFramePoolDebug enables or disables tracking the frames
+// acquired by AcquireFrame and released by ReleaseFrame.
+//
+// It allows finding the frames that are never released, i.e. by a handler
+// that acquires a frame but doesn't write nor release it, using FrameLeaks.
+// Tracking the frames is slow, so it must only be enabled to debug the leaks.
+// When disabled, AcquireFrame and ReleaseFrame don't track anything.
+//
+// Enabling it resets the counters returned by ReadFramePoolStats.
+func SetFramePoolDebug(enable bool) {
+	frameTracker.mu.Lock()
+	defer frameTracker.mu.Unlock()
+
+	if enable {
+		frameTracker.acquired = 0
+		frameTracker.released = 0
+		frameTracker.frames = make(map[*Frame][]uintptr)
+
+		atomic.StoreInt32(&framePoolDebug, 1)
+	} else {
+		atomic.StoreInt32(&framePoolDebug, 0)
+
+		frameTracker.frames = nil
+	}
+}
+
+// FramePoolStats are the counters of the frames tracked by SetFramePoolDebug.
+type FramePoolStats struct {
+	// Acquired is the number of frames acquired using AcquireFrame.
+	Acquired uint64
+	// Released is the number of frames released using ReleaseFrame.
+	Released uint64
+	// Outstanding is the number of frames acquired but not released yet.
+	//
+	// The frames acquired before enabling the debug mode are not counted.
+	Outstanding int
+}
+
+// ReadFramePoolStats returns the counters of the frame pool.
+//
+// The counters are only updated while the debug mode is enabled.
+func ReadFramePoolStats() FramePoolStats {
+	frameTracker.mu.Lock()
+	defer frameTracker.mu.Unlock()
+
+	return FramePoolStats{
+		Acquired:    frameTracker.acquired,
+		Released:    frameTracker.released,
+		Outstanding: len(frameTracker.frames),
+	}
+}
+
+// FrameLeaks returns the stack traces of the calls to AcquireFrame
+// whose frames haven't been released yet.
+//
+// The frames being used, like the ones queued by a connection,
+// are reported too, so FrameLeaks should be called once the
+// connections are closed or the traffic has stopped.
+func FrameLeaks() []string {
+	frameTracker.mu.Lock()
+	defer frameTracker.mu.Unlock()
+
+	leaks := make([]string, 0, len(frameTracker.frames))
+	for _, pcs := range frameTracker.frames {
+		leaks = append(leaks, formatStack(pcs))
+	}
+
+	return leaks
+}
+
+func trackAcquire(fr *Frame) {
+	pcs := make([]uintptr, 32)
+	// skip runtime.Callers, trackAcquire and AcquireFrame
+	pcs = pcs[:runtime.Callers(3, pcs)]
+
+	frameTracker.mu.Lock()
+	if frameTracker.frames != nil {
+		frameTracker.acquired++
+		frameTracker.frames[fr] = pcs
+	}
+	frameTracker.mu.Unlock()
+}
+
+func trackRelease(fr *Frame) {
+	frameTracker.mu.Lock()
+	if frameTracker.frames != nil {
+		frameTracker.released++
+		delete(frameTracker.frames, fr)
+	}
+	frameTracker.mu.Unlock()
+}
+
+func formatStack(pcs []uintptr) string {
+	var sb strings.Builder
+
+	frames := runtime.CallersFrames(pcs)
+	for {
+		f, more := frames.Next()
+
+		sb.WriteString(f.Function)
+		sb.WriteString("\n\t")
+		sb.WriteString(f.File)
+		sb.WriteByte(':')
+		sb.WriteString(strconv.Itoa(f.Line))
+		sb.WriteByte('\n')
+
+		if !more {
+			break
+		}
+	}
+
+	return sb.String()
+}
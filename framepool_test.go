@@ -0,0 +1,52 @@
+package websocket
+
+import (
+	"strings"
+	"testing"
+)
+
+func countLeaks(fn string) int {
+	n := 0
+	for _, stack := range FrameLeaks() {
+		if strings.Contains(stack, fn) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestFramePoolDebug(t *testing.T) {
+	SetFramePoolDebug(true)
+	defer SetFramePoolDebug(false)
+
+	fr1 := AcquireFrame()
+	fr2 := AcquireFrame()
+
+	ReleaseFrame(fr1)
+
+	if n := countLeaks("TestFramePoolDebug"); n != 1 {
+		t.Fatalf("Expecting 1 leak, got %d", n)
+	}
+
+	st := ReadFramePoolStats()
+	if st.Acquired < 2 || st.Released < 1 || st.Outstanding < 1 {
+		t.Fatalf("Unexpected stats %+v", st)
+	}
+
+	ReleaseFrame(fr2)
+
+	if n := countLeaks("TestFramePoolDebug"); n != 0 {
+		t.Fatalf("Expecting no leaks, got %d", n)
+	}
+
+	SetFramePoolDebug(false)
+
+	// the frames are not tracked once disabled
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	if n := len(FrameLeaks()); n != 0 {
+		t.Fatalf("Expecting no leaks, got %d", n)
+	}
+}
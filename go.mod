@@ -1,6 +1,6 @@
 module github.com/dgrr/websocket
 
-go 1.6
+go 1.23
 
 require (
 	github.com/gobwas/ws v1.0.4
@@ -9,3 +9,10 @@ require (
 	github.com/valyala/fasthttp v1.28.0
 	nhooyr.io/websocket v1.8.6
 )
+
+require (
+	github.com/andybalholm/brotli v1.0.2 // indirect
+	github.com/gobwas/httphead v0.0.0-20180130184737-2c6c146eadee // indirect
+	github.com/gobwas/pool v0.2.0 // indirect
+	github.com/klauspost/compress v1.12.2 // indirect
+)
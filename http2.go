@@ -0,0 +1,124 @@
+package websocket
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serveConnect serves a WebSocket connection upgraded using
+// the HTTP/2 extended CONNECT (RFC 8441).
+//
+// The connection is the HTTP/2 stream: the frames are read from
+// the request body and written into the response.
+func (s *Server) serveConnect(resp http.ResponseWriter, req *http.Request, hs *handshake) {
+	h := resp.Header()
+
+	h.Del(b2s(wsHeaderExtensions))
+	if hs.compress {
+		h.Set(b2s(wsHeaderExtensions), b2s(hs.appendExtensions(nil)))
+	}
+
+	// the upgrade handler might have chosen the subprotocol
+	hs.proto = h.Get(b2s(wsHeaderProtocol))
+	if hs.proto == "" {
+		hs.proto = selectProtocol(hs.protos, s.Protocols)
+		if hs.proto != "" {
+			h.Set(b2s(wsHeaderProtocol), hs.proto)
+		}
+	}
+
+	rc := http.NewResponseController(resp)
+
+	resp.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ctx := req.Context()
+	if s.OnNetUpgrade != nil {
+		ctx = s.OnNetUpgrade(req)
+	}
+
+	c := &streamConn{
+		r:      req.Body,
+		w:      resp,
+		rc:     rc,
+		remote: stringAddr(req.RemoteAddr),
+	}
+
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.local = addr
+	}
+
+	// the stream is closed when the handler returns
+	s.serveConn(s.acquireConn(c, ctx, hs))
+}
+
+// streamConn is a net.Conn over an HTTP/2 stream.
+type streamConn struct {
+	r  io.ReadCloser
+	w  io.Writer
+	rc *http.ResponseController
+
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Write writes b into the stream, flushing it,
+// since the frames are already buffered by the Conn.
+func (c *streamConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err == nil {
+		err = c.rc.Flush()
+	}
+
+	return n, err
+}
+
+// Close unblocks the pending reads and writes.
+func (c *streamConn) Close() error {
+	c.rc.SetWriteDeadline(aLongTimeAgo)
+
+	return c.r.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
+
+// stringAddr is the address of the peer given by http.Request.RemoteAddr.
+type stringAddr string
+
+func (a stringAddr) Network() string {
+	return "tcp"
+}
+
+func (a stringAddr) String() string {
+	return string(a)
+}
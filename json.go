@@ -0,0 +1,72 @@
+package websocket
+
+import (
+	"encoding/json"
+
+	"github.com/valyala/bytebufferpool"
+)
+
+// JSONMarshal is the function used by WriteJSON to encode the values.
+//
+// It can be replaced by any encoding/json compatible implementation.
+var JSONMarshal = json.Marshal
+
+// JSONUnmarshal is the function used by ReadJSON to decode the messages.
+//
+// It can be replaced by any encoding/json compatible implementation.
+// The messages received by the MessageHandler can be decoded with it too.
+var JSONUnmarshal = json.Unmarshal
+
+// WriteJSON writes the JSON encoding of v as a text message.
+func (c *Conn) WriteJSON(v interface{}) error {
+	b, err := JSONMarshal(v)
+	if err != nil {
+		return err
+	}
+
+	fr := AcquireFrame()
+	fr.SetFin()
+	fr.SetText()
+	fr.SetPayload(b)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if !c.queue(fr) {
+		return ErrConnClosed
+	}
+
+	return nil
+}
+
+// WriteJSON writes the JSON encoding of v as a text message.
+func (c *Client) WriteJSON(v interface{}) error {
+	b, err := JSONMarshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Write(b)
+
+	return err
+}
+
+// ReadJSON reads a complete message and decodes it into v.
+//
+// The control frames are handled as in ReadFull.
+func (c *Client) ReadJSON(v interface{}) error {
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	bf := bytebufferpool.Get()
+	defer bytebufferpool.Put(bf)
+
+	b, err := c.ReadFull(bf.B[:0], fr)
+	bf.B = b
+
+	if err == nil {
+		err = JSONUnmarshal(b, v)
+	}
+
+	return err
+}
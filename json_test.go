@@ -0,0 +1,73 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type jsonMessage struct {
+	ID   int    `json:"id"`
+	Text string `json:"text"`
+}
+
+func TestJSON(t *testing.T) {
+	ws := Server{}
+
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		var msg jsonMessage
+		if err := JSONUnmarshal(data, &msg); err != nil {
+			t.Error(err)
+			return
+		}
+
+		msg.ID++
+
+		if err := c.WriteJSON(&msg); err != nil {
+			t.Error(err)
+		}
+	})
+
+	conn := dialServer(t, &ws)
+
+	if err := conn.WriteJSON(jsonMessage{ID: 1, Text: "Hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg jsonMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.ID != 2 || msg.Text != "Hello" {
+		t.Fatalf("Unexpected message: %+v", msg)
+	}
+
+	conn.Close()
+}
+
+func TestJSONCodec(t *testing.T) {
+	calls := 0
+	JSONMarshal = func(v interface{}) ([]byte, error) {
+		calls++
+		return json.Marshal(v)
+	}
+	defer func() { JSONMarshal = json.Marshal }()
+
+	c := &Conn{}
+	c.reset(nil)
+
+	if err := c.WriteJSON(jsonMessage{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 1 {
+		t.Fatalf("Expecting the custom codec to be used, got %d calls", calls)
+	}
+
+	fr := <-c.output
+	defer ReleaseFrame(fr)
+
+	if !fr.IsText() || string(fr.Payload()) != `{"id":0,"text":""}` {
+		t.Fatalf("Unexpected frame: %s", fr)
+	}
+}
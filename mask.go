@@ -2,10 +2,24 @@ package websocket
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 )
 
+// mask XORs b with the 4 bytes key mask.
+//
+// The payload is processed 8 bytes at a time using the key
+// repeated twice, and the remaining bytes one by one.
 func mask(mask, b []byte) {
-	for i := range b {
+	key := binary.LittleEndian.Uint32(mask)
+	key64 := uint64(key)<<32 | uint64(key)
+
+	i := 0
+	for ; len(b)-i >= 8; i += 8 {
+		v := binary.LittleEndian.Uint64(b[i:])
+		binary.LittleEndian.PutUint64(b[i:], v^key64)
+	}
+
+	for ; i < len(b); i++ {
 		b[i] ^= mask[i&3]
 	}
 }
@@ -19,3 +19,49 @@ func TestUnmask(t *testing.T) {
 		t.Fatalf("%v <> %s", m, unmasked)
 	}
 }
+
+func maskBytes(mask, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i&3]
+	}
+}
+
+func TestMaskLengths(t *testing.T) {
+	key := []byte{0x37, 0xfa, 0x21, 0x3d}
+
+	for n := 0; n < 67; n++ {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(i * 7)
+		}
+
+		expect := append([]byte(nil), b...)
+		maskBytes(key, expect)
+
+		mask(key, b)
+		if !bytes.Equal(b, expect) {
+			t.Fatalf("%d: %x <> %x", n, b, expect)
+		}
+	}
+}
+
+func BenchmarkMask(b *testing.B) {
+	key := []byte{0x37, 0xfa, 0x21, 0x3d}
+	payload := make([]byte, 1<<20)
+
+	b.Run("Words", func(b *testing.B) {
+		b.SetBytes(int64(len(payload)))
+
+		for i := 0; i < b.N; i++ {
+			mask(key, payload)
+		}
+	})
+
+	b.Run("Bytes", func(b *testing.B) {
+		b.SetBytes(int64(len(payload)))
+
+		for i := 0; i < b.N; i++ {
+			maskBytes(key, payload)
+		}
+	})
+}
@@ -3,17 +3,28 @@ package websocket
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/valyala/bytebufferpool"
 	"github.com/valyala/fasthttp"
 )
 
+var (
+	// ErrServerClosed is passed to the CloseHandler of the connections
+	// closed by Server.Shutdown.
+	ErrServerClosed = errors.New("server closed")
+)
+
 type (
 	// OpenHandler handles when a connection is open.
 	OpenHandler func(c *Conn)
@@ -24,51 +35,283 @@ type (
 	// MessageHandler receives the payload content of a data frame
 	// indicating whether the content is binary or not.
 	MessageHandler func(c *Conn, isBinary bool, data []byte)
+	// TextHandler receives the payload of a text message.
+	TextHandler func(c *Conn, data []byte)
+	// BinaryHandler receives the payload of a binary message.
+	BinaryHandler func(c *Conn, data []byte)
+	// MessageReaderHandler receives the payload of a data message as a stream,
+	// indicating whether the content is binary or not.
+	//
+	// r returns io.EOF after the last fragment of the message.
+	MessageReaderHandler func(c *Conn, isBinary bool, r io.Reader)
 	// FrameHandler receives the raw frame. This handler is optional,
 	// if none is specified the server will run a default handler.
 	//
 	// If the user specifies a FrameHandler, then it is going to receive all incoming frames.
+	// The frames are delivered as read: still masked, with the reserved bits
+	// and the payload untouched, so they can be relayed byte for byte using
+	// Frame.WriteTo. The control frames are not answered by the server either.
+	//
+	// fr is released once the handler returns, so neither fr nor its payload
+	// can be used afterwards, and fr must not be released or passed to Conn.WriteFrame.
+	// Use Frame.Clone or Frame.CopyPayload to retain or forward them.
 	FrameHandler func(c *Conn, fr *Frame)
+	// FrameMetaHandler observes the header of each frame received,
+	// before the frame is handled.
+	//
+	// opcode is the frame's opcode, as sent by the peer, and length the payload
+	// length declared by the frame. rsv holds the RSV1, RSV2 and RSV3 bits
+	// as 4, 2 and 1 respectively.
+	FrameMetaHandler func(c *Conn, opcode uint8, length uint64, fin, masked bool, rsv uint8)
 	// CloseHandler fires when a connection has been closed.
+	//
+	// err is nil if the connection was closed cleanly (StatusNone).
+	// Otherwise err is an Error holding the peer's close status, or
+	// StatusAbnormalClosure if the connection was dropped without a close frame.
+	// The error that dropped the connection can be checked using errors.Is.
+	//
+	// The writes into c return ErrConnClosed after the CloseHandler returns.
 	CloseHandler func(c *Conn, err error)
+	// CloseFrameHandler receives the status and reason of the peer's close frame
+	// and returns the status and reason of the close frame sent back.
+	CloseFrameHandler func(c *Conn, status StatusCode, reason []byte) (StatusCode, string)
 	// ErrorHandler fires when an unknown error happens.
+	//
+	// It also receives the temporary write errors: timeouts and io.ErrShortWrite
+	// that happened before any byte of the frame was written. The frame is discarded
+	// but the connection stays open, so the handler can decide whether to close it.
+	// Any other write error is fatal: the connection is closed and the
+	// error is passed to the CloseHandler.
+	//
+	// When no PanicHandler is set, it receives the panics recovered from the handlers.
 	ErrorHandler func(c *Conn, err error)
+	// PanicHandler receives the value and the stack trace of a panic recovered
+	// from the handlers. The connection is closed with StatusUnexpected afterwards.
+	PanicHandler func(c *Conn, v interface{}, stack []byte)
 )
 
+// Logger is used for logging the errors the server can't report
+// through the handlers, like write errors.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
 // Server represents the WebSocket server.
 //
 // Server is going to be in charge of upgrading the connection, is not a server per-se.
 type Server struct {
 	// UpgradeHandler allows the user to handle RequestCtx when upgrading for fasthttp.
 	//
-	// If UpgradeHandler returns false the connection won't be upgraded.
+	// If UpgradeHandler returns false the connection won't be upgraded,
+	// and the response set by the handler is sent. If no status was set,
+	// the response is 403 Forbidden.
+	//
+	// The response headers set by UpgradeHandler, like cookies, are sent in the
+	// switching protocols response. If it sets the Sec-WebSocket-Protocol header,
+	// that subprotocol is used instead of the one selected from Protocols.
 	UpgradeHandler UpgradeHandler
 
 	// UpgradeHandler allows the user to handle the request when upgrading for net/http.
 	//
-	// If UpgradeNetHandler returns false, the connection won't be upgraded.
+	// If UpgradeNetHandler returns false, the connection won't be upgraded,
+	// and the response written by the handler is sent. If it didn't write
+	// anything, the response is 403 Forbidden.
+	//
+	// The headers set in resp.Header() are sent in the switching protocols response
+	// like the ones set by UpgradeHandler.
 	UpgradeNetHandler UpgradeNetHandler
 
+	// OnNetUpgrade returns the context of the connections upgraded by NetUpgrade.
+	//
+	// By default the request's context is used, so the values stored in it by
+	// the middlewares using string keys are returned by Conn.UserValue,
+	// like the user values of the fasthttp.RequestCtx for Upgrade.
+	// OnNetUpgrade can add other values or return a context not bound to the request.
+	OnNetUpgrade func(req *http.Request) context.Context
+
 	// Protocols are the supported protocols.
 	Protocols []string
 
+	// RetainHeaders are the request headers kept after the upgrade,
+	// so they can be read using Conn.RequestHeader once the request is gone.
+	//
+	// Only the listed headers are copied, like User-Agent or Cookie.
+	RetainHeaders []string
+
 	// Origin is used to limit the clients coming from the defined origin
 	Origin string
 
+	// CheckOrigin reports whether the connection coming from origin is allowed.
+	//
+	// If CheckOrigin is set it overrides Origin, allowing to match
+	// many origins or wildcard subdomains.
+	CheckOrigin func(origin []byte) bool
+
+	// RequireHeaders are the request headers an upgrade must carry,
+	// mapped to their expected value. An empty value only requires
+	// the header to be present.
+	//
+	// The upgrades missing a header or carrying a different value are
+	// rejected with 403 Forbidden before the UpgradeHandler is called.
+	// The values sent in multiple lines are joined before comparing them.
+	RequireHeaders map[string]string
+
+	// RequireProtocolMatch rejects the upgrade if none of the protocols
+	// requested by the client is in Protocols, including when the client
+	// doesn't send the Sec-WebSocket-Protocol header.
+	//
+	// By default the server falls back to the first protocol sent by the client.
+	// When RequireProtocolMatch is set the connection is rejected with
+	// 400 Bad Request before being hijacked, so the OpenHandler only fires
+	// for connections whose negotiation succeeded.
+	RequireProtocolMatch bool
+
+	// EnableCompression enables the permessage-deflate extension (RFC 7692)
+	// when it's offered by the client.
+	//
+	// The context takeover is always disabled, so every message is compressed
+	// independently. Only the messages written in a single frame are compressed.
+	// See Conn.SetCompressionLevel and Conn.EnableWriteCompression.
+	EnableCompression bool
+
+	// EnableLegacyDeflate accepts the non-standard x-webkit-deflate-frame
+	// extension, used by old WebKit based browsers, when the client
+	// doesn't offer permessage-deflate or EnableCompression is false.
+	//
+	// The frames received are decompressed one by one. The messages are
+	// written like with permessage-deflate, so the same settings apply.
+	EnableLegacyDeflate bool
+
+	// RequireCompression rejects the upgrade with 400 Bad Request if
+	// no compression extension enabled by EnableCompression or
+	// EnableLegacyDeflate is negotiated, like RequireProtocolMatch.
+	RequireCompression bool
+
+	// IdleTimeout is the maximum time a connection can stay
+	// without reading or writing any frame.
+	//
+	// When it's exceeded the connection is closed with StatusGoAway and
+	// the CloseHandler receives an Error wrapping ErrIdleTimeout.
+	// Unlike ReadTimeout, no ping is required to keep the connection alive
+	// as long as the peers exchange messages. By default there's no timeout.
+	IdleTimeout time.Duration
+
+	// TCPKeepAlive enables the TCP keep-alives on the upgraded connections,
+	// using TCPKeepAlive as the period between the keep-alive probes.
+	//
+	// The keep-alives let the kernel detect the dead peers without
+	// sending any ping. The connections that aren't TCP are left untouched,
+	// the TLS connections are configured through their underlying connection.
+	// By default the keep-alive settings are not changed.
+	TCPKeepAlive time.Duration
+
+	// DisableNoDelay enables the Nagle's algorithm on the upgraded TCP connections.
+	//
+	// By default TCP_NODELAY is set, so the small frames are sent right away,
+	// which lowers the latency of interactive applications. Enabling the Nagle's
+	// algorithm coalesces the small writes into fewer packets, trading latency
+	// for throughput. The frames queued together are already written at once.
+	DisableNoDelay bool
+
+	// DisableAutoPong stops the server from replying the pings with a pong.
+	//
+	// The ping data is still delivered to the PingHandler, so the application
+	// controls the response. The RFC requires a pong to be sent eventually,
+	// so the handler must reply using Conn.WriteControl or Conn.WriteFrame.
+	DisableAutoPong bool
+
+	// WriteBufferFrames is the number of frames that can be queued
+	// into a connection before being written.
+	//
+	// When the buffer is full, WriteFrame and Write block until the
+	// write loop writes the queued frames into the connection.
+	// By default WriteBufferFrames is DefaultBufferFrames.
+	WriteBufferFrames int
+
+	// ReadBufferFrames is the number of frames that can be read
+	// from a connection before being handled.
+	//
+	// By default the frames are read by the goroutine running the handlers,
+	// one at a time, so each connection runs two goroutines: that one and
+	// the write loop. Setting ReadBufferFrames reads the frames ahead in a
+	// dedicated goroutine instead, so a slow handler doesn't stop the reads
+	// until the buffer is full, and then Conn.ReadBlocked returns true.
+	// The channel returned by Conn.Messages buffers as many messages.
+	//
+	// Without the read ahead, the write errors that don't close the connection
+	// are reported once the next frame is handled, and once the connection is
+	// closed the server waits up to 3 seconds for the peer's close frame.
+	ReadBufferFrames int
+
+	// ReadBufferBytes limits the payload size of the frames read
+	// from a connection before being handled.
+	//
+	// Each buffered frame can be as big as MaxPayloadSize, so ReadBufferFrames
+	// alone can hold a lot of memory when the peer sends faster than the
+	// handlers process. Once the frames waiting for the handlers reach
+	// ReadBufferBytes the connection is not read, letting the TCP flow control
+	// throttle the peer, and Conn.ReadBlocked returns true. The frame that
+	// reaches the limit is still read.
+	//
+	// Setting ReadBufferBytes reads the frames ahead, up to DefaultBufferFrames
+	// unless ReadBufferFrames is set. By default the frames are not read ahead.
+	ReadBufferBytes int
+
+	// ReadBufferSize is the size of the buffer used to read from the connection.
+	//
+	// A larger buffer trades memory per connection for fewer reads
+	// when receiving large frames. Zero keeps the bufio default size.
+	ReadBufferSize int
+
+	// WriteBufferSize is the size of the buffer the frames are written into
+	// before being flushed to the connection.
+	//
+	// A larger buffer trades memory per connection for fewer writes
+	// when sending large frames. Zero keeps the bufio default size.
+	WriteBufferSize int
+
+	// Logger logs the connection errors, including the fields
+	// returned by Conn.LogFields.
+	//
+	// By default nothing is logged.
+	Logger Logger
+
 	nextID uint64
 
-	openHandler  OpenHandler
-	frHandler    FrameHandler
-	closeHandler CloseHandler
-	msgHandler   MessageHandler
-	pingHandler  PingHandler
-	pongHandler  PongHandler
-	errHandler   ErrorHandler
+	// conns are the connections being served.
+	connsMu sync.RWMutex
+	conns   map[*Conn]struct{}
+
+	// shutdown is closed when Shutdown is called.
+	shutdown       chan struct{}
+	shutdownOnce   sync.Once
+	shutdownCtx    context.Context
+	cancelShutdown context.CancelFunc
+	shutdownStatus StatusCode
+	shutdownReason string
+
+	openHandler    OpenHandler
+	frHandler      FrameHandler
+	frMetaHandler  FrameMetaHandler
+	closeHandler   CloseHandler
+	closeFrHandler CloseFrameHandler
+	msgHandler     MessageHandler
+	textHandler    TextHandler
+	binaryHandler  BinaryHandler
+	readHandler    MessageReaderHandler
+	pingHandler    PingHandler
+	pongHandler    PongHandler
+	errHandler     ErrorHandler
+	panicHandler   PanicHandler
 
 	once sync.Once
 }
 
 func (s *Server) initServer() {
+	s.shutdown = make(chan struct{})
+	// the connections reading inline watch the shutdown using a context
+	s.shutdownCtx, s.cancelShutdown = context.WithCancel(context.Background())
+
 	if s.frHandler != nil {
 		return
 	}
@@ -81,6 +324,30 @@ func (s *Server) HandleData(msgHandler MessageHandler) {
 	s.msgHandler = msgHandler
 }
 
+// HandleText sets the TextHandler.
+//
+// If set, the text messages are delivered to it instead of the MessageHandler.
+func (s *Server) HandleText(textHandler TextHandler) {
+	s.textHandler = textHandler
+}
+
+// HandleBinary sets the BinaryHandler.
+//
+// If set, the binary messages are delivered to it instead of the MessageHandler.
+func (s *Server) HandleBinary(binaryHandler BinaryHandler) {
+	s.binaryHandler = binaryHandler
+}
+
+// HandleMessageReader sets the MessageReaderHandler.
+//
+// The payload is streamed to the handler as the fragments arrive,
+// instead of being buffered until the message is complete.
+// If set, the MessageReaderHandler is called instead of the MessageHandler,
+// the TextHandler and the BinaryHandler.
+func (s *Server) HandleMessageReader(readHandler MessageReaderHandler) {
+	s.readHandler = readHandler
+}
+
 // HandleOpen sets a callback for handling opening connections.
 func (s *Server) HandleOpen(openHandler OpenHandler) {
 	s.openHandler = openHandler
@@ -91,10 +358,20 @@ func (s *Server) HandleClose(closeHandler CloseHandler) {
 	s.closeHandler = closeHandler
 }
 
+// HandleCloseFrame sets a callback for handling the close frames sent by the peer
+// before replying to them.
+//
+// The status and reason returned by the handler are sent back in the close frame.
+// The reason is truncated to the 123 bytes that fit in the frame. By default the peer's status is echoed back without any reason.
+// The handler is not called when the close frame acknowledges the one sent by WriteClose.
+func (s *Server) HandleCloseFrame(closeFrHandler CloseFrameHandler) {
+	s.closeFrHandler = closeFrHandler
+}
+
 // HandlePing sets a callback for handling the data of the ping frames.
 //
 // The server is in charge of replying to the PING frames, thus the client
-// MUST not reply to any control frame.
+// MUST not reply to any control frame. See DisableAutoPong.
 func (s *Server) HandlePing(pingHandler PingHandler) {
 	s.pingHandler = pingHandler
 }
@@ -104,351 +381,1350 @@ func (s *Server) HandlePong(pongHandler PongHandler) {
 	s.pongHandler = pongHandler
 }
 
-// HandleError ...
+// HandleFrameMeta sets a callback observing the header of the incoming frames.
+//
+// Unlike HandleFrame, the frames are still handled as usual once the callback
+// returns, so it can be used for logging or metrics. The callback is called
+// before the FrameHandler, so it observes the frames when HandleFrame is used too.
+func (s *Server) HandleFrameMeta(frameMetaHandler FrameMetaHandler) {
+	s.frMetaHandler = frameMetaHandler
+}
+
+// HandleError sets a callback for handling the errors that don't close the connection.
 func (s *Server) HandleError(errHandler ErrorHandler) {
 	s.errHandler = errHandler
 }
 
+// HandlePanic sets a callback for handling the panics in the handlers.
+//
+// The panics are always recovered, closing only the connection whose handler panicked.
+// If none is specified, the panic is logged and passed to the ErrorHandler.
+// The panics in a MessageReaderHandler are reported from its own goroutine.
+func (s *Server) HandlePanic(panicHandler PanicHandler) {
+	s.panicHandler = panicHandler
+}
+
 // HandleFrame sets a callback for handling all the incoming Frames.
 //
 // If none is specified, the server will run a default handler.
+// The frames are released after the handler returns, see FrameHandler.
 func (s *Server) HandleFrame(frameHandler FrameHandler) {
-	s.frHandler = frameHandler
+	s.frHandler = func(c *Conn, fr *Frame) {
+		frameHandler(c, fr)
+		ReleaseFrame(fr)
+	}
 }
 
-// Upgrade upgrades websocket connections.
-func (s *Server) Upgrade(ctx *fasthttp.RequestCtx) {
-	if !ctx.IsGet() {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		return
+// checkHeaders reports whether the request carries the RequireHeaders,
+// using peek to get them.
+func (s *Server) checkHeaders(peek func(key []byte) []byte) bool {
+	for key, value := range s.RequireHeaders {
+		v := peek(s2b(key))
+		if len(v) == 0 || (value != "" && string(v) != value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkOrigin reports whether the connection coming from origin is allowed.
+func (s *Server) checkOrigin(origin []byte) bool {
+	if s.CheckOrigin != nil {
+		return s.CheckOrigin(origin)
+	}
+
+	if s.Origin == "" {
+		return true
 	}
 
+	uri := fasthttp.AcquireURI()
+	uri.Update(s.Origin)
+
+	b := bytePool.Get().([]byte)
+	b = prepareOrigin(b, uri)
+	fasthttp.ReleaseURI(uri)
+
+	ok := equalsFold(b, origin)
+
+	bytePool.Put(b)
+
+	return ok
+}
+
+// Upgrade upgrades websocket connections.
+func (s *Server) Upgrade(ctx *fasthttp.RequestCtx) {
 	s.once.Do(s.initServer)
 
-	// Checking Origin header if needed
-	origin := ctx.Request.Header.Peek("Origin")
-	if s.Origin != "" {
-		uri := fasthttp.AcquireURI()
-		uri.Update(s.Origin)
-
-		b := bytePool.Get().([]byte)
-		b = prepareOrigin(b, uri)
-		fasthttp.ReleaseURI(uri)
-
-		if !equalsFold(b, origin) {
-			ctx.SetStatusCode(fasthttp.StatusForbidden)
-			bytePool.Put(b)
-			return
-		}
+	peek := peekAll(&ctx.Request.Header)
 
-		bytePool.Put(b)
+	hs, status, reason := s.readHandshake(ctx.Method(), peek)
+	if status != 0 {
+		ctx.Error(reason, status)
+		return
+	}
+
+	if !hs.isUpgrade() {
+		return
 	}
 
 	// Normalizing must be disabled because of WebSocket header fields.
 	// (This is not a fasthttp bug).
 	ctx.Response.Header.DisableNormalizing()
 
-	// Connection.Value == Upgrade
-	if ctx.Request.Header.ConnectionUpgrade() {
-		// Peek sade header field.
-		hup := ctx.Request.Header.PeekBytes(upgradeString)
-		// Compare with websocket string defined by the RFC
-		if equalsFold(hup, websocketString) {
-			// Checking websocket version
-			hversion := ctx.Request.Header.PeekBytes(wsHeaderVersion)
-
-			// Peeking websocket key.
-			hkey := ctx.Request.Header.PeekBytes(wsHeaderKey)
-			hprotos := bytes.Split( // TODO: Reduce allocations. Do not split. Use IndexByte
-				ctx.Request.Header.PeekBytes(wsHeaderProtocol), commaString,
-			)
-
-			supported := false
-			// Checking versions
-			for i := range supportedVersions {
-				if bytes.Contains(supportedVersions[i], hversion) {
-					supported = true
-					break
-				}
-			}
-
-			if !supported {
-				ctx.Error("Versions not supported", fasthttp.StatusBadRequest)
-				return
+	if s.UpgradeHandler != nil {
+		if !s.UpgradeHandler(ctx) {
+			// the status can't be told apart from the default one,
+			// but a rejected upgrade can't be 200 OK anyway.
+			if ctx.Response.StatusCode() == fasthttp.StatusOK {
+				ctx.SetStatusCode(fasthttp.StatusForbidden)
 			}
 
-			if s.UpgradeHandler != nil {
-				if !s.UpgradeHandler(ctx) {
-					return
-				}
-			}
-			// TODO: compression
-			// compress := mustCompress(exts)
-
-			// Setting response headers
-			ctx.Response.SetStatusCode(fasthttp.StatusSwitchingProtocols)
-			ctx.Response.Header.AddBytesKV(connectionString, upgradeString)
-			ctx.Response.Header.AddBytesKV(upgradeString, websocketString)
-			ctx.Response.Header.AddBytesKV(wsHeaderAccept, makeKey(hkey, hkey))
-
-			// TODO: implement bad websocket version
-			// https://tools.ietf.org/html/rfc6455#section-4.4
-			if proto := selectProtocol(hprotos, s.Protocols); proto != "" {
-				ctx.Response.Header.AddBytesK(wsHeaderProtocol, proto)
-			}
+			return
+		}
+	}
 
-			nctx := context.Background()
-			ctx.VisitUserValues(func(k []byte, v interface{}) {
-				nctx = context.WithValue(nctx, string(k), v)
-			})
+	s.retainHeaders(&hs, peek)
 
-			ctx.Hijack(func(c net.Conn) {
-				if nc, ok := c.(interface {
-					UnsafeConn() net.Conn
-				}); ok {
-					c = nc.UnsafeConn()
-				}
+	hs.path = string(ctx.Path())
+	hs.query = string(ctx.URI().QueryString())
 
-				conn := acquireConn(c)
-				conn.id = atomic.AddUint64(&s.nextID, 1)
-				// establishing default options
-				conn.ctx = nctx
+	ctx.Response.SetStatusCode(fasthttp.StatusSwitchingProtocols)
+	s.writeHandshake(&ctx.Response.Header, &hs)
 
-				if s.openHandler != nil {
-					s.openHandler(conn)
-				}
+	nctx := context.Background()
+	ctx.VisitUserValues(func(k []byte, v interface{}) {
+		nctx = context.WithValue(nctx, string(k), v)
+	})
 
-				s.serveConn(conn)
-			})
+	ctx.Hijack(func(c net.Conn) {
+		if nc, ok := c.(interface {
+			UnsafeConn() net.Conn
+		}); ok {
+			c = nc.UnsafeConn()
 		}
-	}
+
+		s.serveConn(s.acquireConn(c, nctx, &hs))
+	})
 }
 
 // NetUpgrade upgrades the websocket connection for net/http.
+//
+// NetUpgrade doesn't return until the connection is closed,
+// so the request's context stays valid while the connection is served.
+//
+// The HTTP/2 extended CONNECT requests (RFC 8441) are upgraded too,
+// serving the connection over the request's stream instead of hijacking it.
 func (s *Server) NetUpgrade(resp http.ResponseWriter, req *http.Request) {
-	if req.Method != "GET" {
-		resp.WriteHeader(http.StatusBadRequest)
+	s.once.Do(s.initServer)
+
+	peek := func(key []byte) []byte {
+		return s2b(strings.Join(req.Header.Values(b2s(key)), ", "))
+	}
+
+	var (
+		hs     handshake
+		status int
+		reason string
+	)
+
+	if req.Method == http.MethodConnect && req.ProtoMajor == 2 {
+		hs, status, reason = s.readConnectHandshake(peek)
+	} else {
+		hs, status, reason = s.readHandshake(s2b(req.Method), peek)
+	}
+
+	if status != 0 {
+		resp.WriteHeader(status)
+		io.WriteString(resp, reason)
 		return
 	}
 
-	rs := fasthttp.AcquireResponse()
-	defer fasthttp.ReleaseResponse(rs)
+	if !hs.isUpgrade() {
+		return
+	}
 
-	s.once.Do(s.initServer)
+	if s.UpgradeNetHandler != nil {
+		rw := &rejectWriter{ResponseWriter: resp}
+		if !s.UpgradeNetHandler(rw, req) {
+			if !rw.wrote {
+				resp.WriteHeader(http.StatusForbidden)
+			}
 
-	// Checking Origin header if needed
-	origin := req.Header.Get("Origin")
-	if s.Origin != "" {
-		uri := fasthttp.AcquireURI()
-		uri.Update(s.Origin)
-
-		b := bytePool.Get().([]byte)
-		b = prepareOrigin(b, uri)
-		fasthttp.ReleaseURI(uri)
-
-		if !equalsFold(b, s2b(origin)) {
-			resp.WriteHeader(http.StatusForbidden)
-			bytePool.Put(b)
 			return
 		}
+	}
+
+	s.retainHeaders(&hs, peek)
+
+	hs.path = req.URL.Path
+	hs.query = req.URL.RawQuery
 
-		bytePool.Put(b)
+	if hs.connect {
+		s.serveConnect(resp, req, &hs)
+		return
+	}
+
+	h, ok := resp.(http.Hijacker)
+	if !ok {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
+	rs := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(rs)
+
 	// Normalizing must be disabled because of WebSocket header fields.
 	// (This is not a fasthttp bug).
 	rs.Header.DisableNormalizing()
 
-	hasUpgrade := func() bool {
-		for _, v := range req.Header["Connection"] {
-			if strings.Contains(v, "Upgrade") {
-				return true
-			}
+	// the headers set by the UpgradeNetHandler, but the extensions
+	resp.Header().Del(b2s(wsHeaderExtensions))
+	for k, vs := range resp.Header() {
+		for _, v := range vs {
+			rs.Header.Add(k, v)
 		}
-		return false
-	}()
+	}
 
-	// Connection.Value == Upgrade
-	if hasUpgrade {
-		// Peek sade header field.
-		hup := req.Header.Get("Upgrade")
-		// Compare with websocket string defined by the RFC
-		if equalsFold(s2b(hup), websocketString) {
-			// Checking websocket version
-			hversion := req.Header.Get(b2s(wsHeaderVersion))
-			// Peeking websocket key.
-			hkey := req.Header.Get(b2s(wsHeaderKey))
-			hprotos := bytes.Split( // TODO: Reduce allocations. Do not split. Use IndexByte
-				s2b(req.Header.Get(b2s(wsHeaderProtocol))), commaString,
-			)
-			supported := false
-			// Checking versions
-			for i := range supportedVersions {
-				if bytes.Contains(supportedVersions[i], s2b(hversion)) {
-					supported = true
-					break
-				}
-			}
-			if !supported {
-				resp.WriteHeader(http.StatusBadRequest)
-				io.WriteString(resp, "Versions not supported")
-				return
-			}
+	rs.SetStatusCode(fasthttp.StatusSwitchingProtocols)
+	s.writeHandshake(&rs.Header, &hs)
 
-			if s.UpgradeNetHandler != nil {
-				if !s.UpgradeNetHandler(resp, req) {
-					return
-				}
-			}
-			// TODO: compression
+	c, _, err := h.Hijack()
+	if err != nil {
+		io.WriteString(resp, err.Error())
+		return
+	}
 
-			h, ok := resp.(http.Hijacker)
-			if !ok {
-				resp.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+	_, err = rs.WriteTo(c)
+	if err != nil {
+		c.Close()
+		return
+	}
 
-			c, _, err := h.Hijack()
-			if err != nil {
-				io.WriteString(resp, err.Error())
-				return
-			}
+	ctx := req.Context()
+	if s.OnNetUpgrade != nil {
+		ctx = s.OnNetUpgrade(req)
+	}
 
-			// Setting response headers
-			rs.SetStatusCode(fasthttp.StatusSwitchingProtocols)
-			rs.Header.AddBytesKV(connectionString, upgradeString)
-			rs.Header.AddBytesKV(upgradeString, websocketString)
-			rs.Header.AddBytesKV(wsHeaderAccept, makeKey(s2b(hkey), s2b(hkey)))
-			// TODO: implement bad websocket version
-			// https://tools.ietf.org/html/rfc6455#section-4.4
-			if proto := selectProtocol(hprotos, s.Protocols); proto != "" {
-				rs.Header.AddBytesK(wsHeaderProtocol, proto)
-			}
+	// the request's context is cancelled when NetUpgrade returns,
+	// so the connection must be served before returning.
+	s.serveConn(s.acquireConn(c, ctx, &hs))
+}
 
-			_, err = rs.WriteTo(c)
-			if err != nil {
-				c.Close()
-				return
-			}
+// ServeConn serves c as a WebSocket connection using the Server handlers.
+//
+// c must be already upgraded, so ServeConn allows doing the handshake
+// outside of Upgrade and NetUpgrade. No subprotocol nor extension is
+// negotiated, so the connection isn't compressed.
+//
+// ctx is returned by Conn.Context, and cancelling it closes the connection.
+// ServeConn doesn't return until the connection is closed.
+func (s *Server) ServeConn(c net.Conn, ctx context.Context) {
+	s.once.Do(s.initServer)
 
-			go func(ctx context.Context) {
-				conn := acquireConn(c)
-				conn.id = atomic.AddUint64(&s.nextID, 1)
-				conn.ctx = ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
 
-				if s.openHandler != nil {
-					s.openHandler(conn)
-				}
+	s.serveConn(s.acquireConn(c, ctx, nil))
+}
 
-				s.serveConn(conn)
-			}(req.Context())
-		}
-	}
+// Pipe returns two connected Conns, using net.Pipe and skipping the handshake.
+//
+// It allows testing the code using a Conn without listening. Both ends run
+// their read and write loops; the messages are received using Conn.Messages,
+// Conn.MessageStream or Conn.WriteTo. Closing one end closes the other.
+func Pipe() (client *Conn, server *Conn) {
+	return new(Server).Pipe()
 }
 
-func (s *Server) serveConn(c *Conn) {
-	var closeErr error
+// Pipe returns two connected Conns like Pipe, with server served by s,
+// so its handlers can be tested without listening.
+func (s *Server) Pipe() (client *Conn, server *Conn) {
+	s.once.Do(s.initServer)
 
-loop:
-	for {
-		select {
-		case fr := <-c.input:
-			s.frHandler(c, fr)
-		case err := <-c.errch:
-			if err == nil {
-				break loop
-			}
+	c1, c2 := net.Pipe()
 
-			if ce, ok := err.(closeError); ok {
-				closeErr = ce.err
-				break loop
-			}
+	cs := new(Server)
+	cs.once.Do(cs.initServer)
 
-			if ce, ok := err.(Error); ok {
-				closeErr = ce
-				break loop
-			}
+	client = cs.acquireConn(c2, context.Background(), nil)
+	client.isClient = true
+	server = s.acquireConn(c1, context.Background(), nil)
 
-			if s.errHandler != nil {
-				s.errHandler(c, err)
-			}
-		case <-c.closer:
-			break loop
-		}
-	}
+	go cs.serveConn(client)
+	go s.serveConn(server)
 
-	if s.closeHandler != nil {
-		s.closeHandler(c, closeErr)
+	return client, server
+}
+
+// Shutdown closes all the connections sending a close frame with status and reason,
+// and rejects the new upgrades with 503 Service Unavailable.
+//
+// If status is zero, StatusGoAway is sent, the status for a server going down.
+// The CloseHandler receives an Error wrapping ErrServerClosed.
+//
+// Shutdown waits until all the connections are closed. If ctx is done before,
+// the remaining connections are left closing and ctx.Err() is returned.
+// The http server must be shut down separately.
+func (s *Server) Shutdown(ctx context.Context, status StatusCode, reason string) error {
+	s.once.Do(s.initServer)
+
+	if status == 0 {
+		status = StatusGoAway
 	}
 
-	c.c.Close()
+	s.shutdownOnce.Do(func() {
+		s.shutdownStatus = status
+		s.shutdownReason = reason
 
-	c.wg.Wait()
-}
+		close(s.shutdown)
+		s.cancelShutdown()
+	})
 
-func (s *Server) handleFrame(c *Conn, fr *Frame) {
-	// TODO: error if not masked
-	if fr.IsMasked() {
-		fr.Unmask()
-	}
+	t := time.NewTicker(shutdownPollInterval)
+	defer t.Stop()
 
-	if fr.IsControl() {
-		s.handleControl(c, fr)
-	} else {
-		s.handleFrameData(c, fr)
+	for s.activeConns() > 0 {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+
+	return nil
 }
 
-func (s *Server) handleFrameData(c *Conn, fr *Frame) {
-	var data []byte
+// shutdownPollInterval is how often Shutdown checks the active connections.
+const shutdownPollInterval = time.Millisecond * 10
 
-	isBinary := fr.Code() == CodeBinary
+func (s *Server) isShutdown() bool {
+	select {
+	case <-s.shutdown:
+		return true
+	default:
+		return false
+	}
+}
 
-	bf := c.buffered
-	if bf == nil {
-		if fr.IsFin() {
-			data = fr.Payload()
-		} else {
-			bf = bytebufferpool.Get()
-			bf.Reset()
+// handshake holds the values of an upgrade request.
+//
+// Upgrade and NetUpgrade parse the request and write the response
+// the same way using readHandshake and writeHandshake.
+type handshake struct {
+	// key is nil if the request is not a WebSocket upgrade.
+	key    []byte
+	protos [][]byte
+	// connect is whether the request is an HTTP/2 extended CONNECT,
+	// which has no key. See readConnectHandshake.
+	connect  bool
+	compress bool
+	// legacyDeflate is whether the compression negotiated is x-webkit-deflate-frame.
+	legacyDeflate bool
+	// deflateMaxWindowBits is whether the permessage-deflate offer
+	// included server_max_window_bits, see negotiateDeflate.
+	deflateMaxWindowBits bool
+	// headers are the request headers listed in RetainHeaders.
+	headers []requestHeader
+	// path and query are the path and the raw query of the request URI.
+	path  string
+	query string
+	// proto is the subprotocol selected by the response.
+	proto string
+}
 
-			c.buffered = bf
-			bf.Write(fr.Payload())
+// peekAll returns a function peeking the headers of h like PeekBytes,
+// but joining the values of the headers sent in multiple lines,
+// like net/http's Header.Values.
+func peekAll(h *fasthttp.RequestHeader) func(key []byte) []byte {
+	return func(key []byte) []byte {
+		n := 0
+		h.VisitAll(func(k, v []byte) {
+			if equalsFold(k, key) {
+				n++
+			}
+		})
+
+		if n < 2 {
+			return h.PeekBytes(key)
 		}
-	} else {
-		bf.Write(fr.Payload())
-		if fr.IsFin() {
-			data = bf.B
-			c.buffered = nil
-			defer bytebufferpool.Put(bf)
+
+		var b []byte
+		h.VisitAll(func(k, v []byte) {
+			if equalsFold(k, key) {
+				if len(b) != 0 {
+					b = append(b, ", "...)
+				}
+				b = append(b, v...)
+			}
+		})
+
+		return b
+	}
+}
+
+// retainHeaders copies the request headers listed in RetainHeaders
+// using peek to get them.
+func (s *Server) retainHeaders(hs *handshake, peek func(key []byte) []byte) {
+	for _, key := range s.RetainHeaders {
+		if v := peek(s2b(key)); len(v) != 0 {
+			hs.headers = append(hs.headers, requestHeader{
+				key:   key,
+				value: string(v),
+			})
 		}
 	}
+}
 
-	if len(data) != 0 && s.msgHandler != nil {
-		s.msgHandler(c, isBinary, data)
+// appendExtensions appends the response to the compression extension negotiated.
+func (hs *handshake) appendExtensions(b []byte) []byte {
+	if hs.legacyDeflate {
+		return appendLegacyDeflateResponse(b)
 	}
 
-	ReleaseFrame(fr)
+	return appendDeflateResponse(b, hs.deflateMaxWindowBits)
 }
 
-func (s *Server) handleControl(c *Conn, fr *Frame) {
-	switch {
-	case fr.IsPing():
-		s.handlePing(c, fr.Payload())
-	case fr.IsPong():
-		s.handlePong(c, fr.Payload())
-	case fr.IsClose():
-		s.handleClose(c, fr)
-	}
+// isUpgrade reports whether the request is a WebSocket upgrade.
+func (hs *handshake) isUpgrade() bool {
+	return hs.key != nil || hs.connect
 }
 
-func (s *Server) handlePing(c *Conn, data []byte) {
-	if s.pingHandler != nil {
-		s.pingHandler(c, data)
+// readHandshake validates the upgrade request, using peek to get its headers.
+//
+// If the request can't be upgraded, it returns the HTTP status and the reason of the error.
+// If the request is not a WebSocket upgrade the key of the handshake is nil.
+func (s *Server) readHandshake(method []byte, peek func(key []byte) []byte) (hs handshake, status int, reason string) {
+	if string(method) != fasthttp.MethodGet {
+		return hs, fasthttp.StatusBadRequest, ""
 	}
 
-	pong := AcquireFrame()
-	pong.SetCode(CodePong)
+	if s.isShutdown() {
+		return hs, fasthttp.StatusServiceUnavailable, ErrServerClosed.Error()
+	}
+
+	// Checking Origin header if needed
+	if !s.checkOrigin(peek(originString)) || !s.checkHeaders(peek) {
+		return hs, fasthttp.StatusForbidden, ""
+	}
+
+	// Connection.Value == Upgrade and Upgrade.Value == websocket
+	if !hasToken(peek(connectionString), upgradeString) ||
+		!equalsFold(peek(upgradeString), websocketString) {
+		return hs, 0, ""
+	}
+
+	hs, status, reason = s.negotiate(peek)
+	if status != 0 {
+		return hs, status, reason
+	}
+
+	key := peek(wsHeaderKey)
+	if !isValidKey(key) {
+		return hs, fasthttp.StatusBadRequest, "Invalid Sec-WebSocket-Key"
+	}
+
+	hs.key = append([]byte{}, key...)
+
+	return hs, 0, ""
+}
+
+// readConnectHandshake validates an HTTP/2 extended CONNECT request,
+// the WebSocket upgrade over HTTP/2 defined by RFC 8441.
+//
+// The request carries the :protocol pseudo-header instead of the Upgrade
+// and Sec-WebSocket-Key headers. If :protocol is not websocket the request
+// is not a WebSocket upgrade.
+func (s *Server) readConnectHandshake(peek func(key []byte) []byte) (hs handshake, status int, reason string) {
+	if !equalsFold(peek(protocolPseudoHeader), websocketString) {
+		return hs, 0, ""
+	}
+
+	if s.isShutdown() {
+		return hs, fasthttp.StatusServiceUnavailable, ErrServerClosed.Error()
+	}
+
+	if !s.checkOrigin(peek(originString)) || !s.checkHeaders(peek) {
+		return hs, fasthttp.StatusForbidden, ""
+	}
+
+	hs, status, reason = s.negotiate(peek)
+	if status == 0 {
+		hs.connect = true
+	}
+
+	return hs, status, reason
+}
+
+// negotiate checks the version and selects the subprotocols
+// and extensions offered by the client.
+func (s *Server) negotiate(peek func(key []byte) []byte) (hs handshake, status int, reason string) {
+	// Checking websocket version
+	hversion := peek(wsHeaderVersion)
+
+	supported := false
+	for i := range supportedVersions {
+		if bytes.Contains(supportedVersions[i], hversion) {
+			supported = true
+			break
+		}
+	}
+
+	if !supported {
+		return hs, fasthttp.StatusBadRequest, "Versions not supported"
+	}
+
+	hs.protos = bytes.Split( // TODO: Reduce allocations. Do not split. Use IndexByte
+		peek(wsHeaderProtocol), commaString,
+	)
+
+	if s.RequireProtocolMatch && matchProtocol(hs.protos, s.Protocols) == "" {
+		return hs, fasthttp.StatusBadRequest, "Protocol not supported"
+	}
+
+	exts := peek(wsHeaderExtensions)
+
+	if s.EnableCompression {
+		hs.compress, hs.deflateMaxWindowBits = negotiateDeflate(exts)
+	}
+
+	if !hs.compress && s.EnableLegacyDeflate && negotiateLegacyDeflate(exts) {
+		hs.compress = true
+		hs.legacyDeflate = true
+	}
+
+	if s.RequireCompression && !hs.compress {
+		return hs, fasthttp.StatusBadRequest, "Extension not supported"
+	}
+
+	return hs, 0, ""
+}
+
+// writeHandshake sets the headers of the switching protocols response into h,
+// storing the selected subprotocol into hs.proto.
+func (s *Server) writeHandshake(h *fasthttp.ResponseHeader, hs *handshake) {
+	h.AddBytesKV(connectionString, upgradeString)
+	h.AddBytesKV(upgradeString, websocketString)
+	h.AddBytesKV(wsHeaderAccept, makeKey(hs.key, hs.key))
+
+	// the extensions are only acknowledged if the server negotiated them,
+	// since the frames wouldn't be handled accordingly otherwise.
+	h.DelBytes(wsHeaderExtensions)
+	if hs.compress {
+		h.AddBytesKV(wsHeaderExtensions, hs.appendExtensions(nil))
+	}
+
+	// TODO: implement bad websocket version
+	// https://tools.ietf.org/html/rfc6455#section-4.4
+	// the upgrade handler might have chosen the subprotocol
+	proto := headerProtocol(h)
+	if proto == "" {
+		proto = selectProtocol(hs.protos, s.Protocols)
+		if proto != "" {
+			h.AddBytesK(wsHeaderProtocol, proto)
+		}
+	}
+
+	hs.proto = proto
+}
+
+// setKeepAlive enables the TCP keep-alives on c if it's a TCP connection.
+func setKeepAlive(c net.Conn, period time.Duration) {
+	if tc := tcpConn(c); tc != nil {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(period)
+	}
+}
+
+// setNoDelay sets TCP_NODELAY on c if it's a TCP connection.
+func setNoDelay(c net.Conn, noDelay bool) {
+	if tc := tcpConn(c); tc != nil {
+		tc.SetNoDelay(noDelay)
+	}
+}
+
+// tcpConn returns the TCP connection underlying c, like the one of a tls.Conn,
+// or nil if c is not a TCP connection.
+func tcpConn(c net.Conn) *net.TCPConn {
+	for {
+		nc, ok := c.(interface {
+			NetConn() net.Conn
+		})
+		if !ok {
+			break
+		}
+
+		c = nc.NetConn()
+	}
+
+	tc, _ := c.(*net.TCPConn)
+
+	return tc
+}
+
+// defaultBufioSize is the buffer size used by bufio.NewReader and bufio.NewWriter.
+const defaultBufioSize = 4096
+
+func bufioSize(size int) int {
+	if size <= 0 {
+		return defaultBufioSize
+	}
+
+	return size
+}
+
+// acquireConn establishes the connection options before
+// starting the read and write loops.
+//
+// hs holds the values negotiated by the upgrade, it's nil
+// if the connection was not upgraded, see ServeConn.
+func (s *Server) acquireConn(c net.Conn, ctx context.Context, hs *handshake) *Conn {
+	if s.TCPKeepAlive > 0 {
+		setKeepAlive(c, s.TCPKeepAlive)
+	}
+
+	setNoDelay(c, !s.DisableNoDelay)
+
+	conn := &Conn{}
+	conn.reset(c)
+
+	if s.WriteBufferFrames > 0 {
+		conn.output = make(chan *Frame, s.WriteBufferFrames)
+	}
+
+	// the frames are read ahead only if a buffer was set,
+	// otherwise they are handled as they are read.
+	switch {
+	case s.ReadBufferFrames > 0:
+		conn.input = make(chan *Frame, s.ReadBufferFrames)
+	case s.ReadBufferBytes == 0:
+		conn.input = nil
+	}
+
+	if s.ReadBufferBytes > 0 {
+		conn.readAheadMax = int64(s.ReadBufferBytes)
+		conn.drained = make(chan struct{}, 1)
+	}
+
+	if size := bufioSize(s.ReadBufferSize); size != defaultBufioSize {
+		releaseReader(conn.br)
+		conn.br = acquireReader(c, size)
+	}
+
+	if size := bufioSize(s.WriteBufferSize); size != defaultBufioSize {
+		releaseWriter(conn.bw)
+		conn.bw = acquireWriter(&conn.cw, size)
+	}
+
+	conn.id = atomic.AddUint64(&s.nextID, 1)
+	conn.ctx = ctx
+	if hs != nil {
+		conn.proto = hs.proto
+		conn.compress = hs.compress
+		conn.legacyDeflate = hs.legacyDeflate
+		conn.headers = hs.headers
+		conn.path = hs.path
+		conn.rawQuery = hs.query
+	}
+	conn.logger = s.Logger
+	conn.inlineReads = conn.input == nil
+
+	// the frames are read once the OpenHandler returns,
+	// so the settings changed by the handler apply to all of them.
+	conn.startWriting()
+
+	return conn
+}
+
+func (s *Server) serveConn(c *Conn) {
+	s.once.Do(s.initServer)
+
+	s.connsMu.Lock()
+	if s.conns == nil {
+		s.conns = make(map[*Conn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	s.connsMu.Unlock()
+
+	closeErr := s.handleConn(c)
+
+	// unblock the MessageReaderHandler waiting for the next fragment
+	if mr := c.reader; mr != nil {
+		// the stream might not be read anymore
+		if sr := c.readingStream; sr != nil {
+			sr.abort(io.ErrUnexpectedEOF)
+		}
+
+		close(mr.frames)
+		<-mr.done
+
+		c.reader = nil
+	}
+
+	if s.closeHandler != nil {
+		s.callCloseHandler(c, closeErr)
+	}
+
+	c.closeOnce.Do(func() { close(c.closer) })
+
+	// no stream is registered once closer is closed
+	c.dropStream()
+	c.closeMessages()
+
+	// give the write loop some time to write the pending frames,
+	// like the close frame, before closing the connection.
+	select {
+	case <-c.writeDone:
+	case <-time.After(closeWriteTimeout):
+	}
+
+	c.c.Close()
+
+	c.wg.Wait()
+
+	if c.unblock != nil {
+		c.unblock.Stop()
+	}
+
+	s.connsMu.Lock()
+	delete(s.conns, c)
+	s.connsMu.Unlock()
+
+	releaseConn(c)
+}
+
+// Range calls f for every connection being served, until f returns false.
+//
+// f is called on a copy of the connections taken when Range starts,
+// so f can close them or block without holding the other connections.
+// The connections opened meanwhile are not visited, and a connection
+// closed meanwhile returns ErrConnClosed on writes.
+func (s *Server) Range(f func(c *Conn) bool) {
+	s.connsMu.RLock()
+	conns := make([]*Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.connsMu.RUnlock()
+
+	for _, c := range conns {
+		if !f(c) {
+			break
+		}
+	}
+}
+
+// activeConns returns the number of connections being served.
+func (s *Server) activeConns() int {
+	s.connsMu.RLock()
+	defer s.connsMu.RUnlock()
+
+	return len(s.conns)
+}
+
+// handleConn runs the handlers of c until the connection is closed,
+// returning the error passed to the CloseHandler.
+//
+// A panic in the handlers closes the connection with StatusUnexpected.
+func (s *Server) handleConn(c *Conn) (closeErr error) {
+	defer func() {
+		if v := recover(); v != nil {
+			closeErr = s.recoverPanic(c, v)
+		}
+	}()
+
+	if s.openHandler != nil {
+		s.openHandler(c)
+	}
+
+	if c.inlineReads {
+		return s.readConn(c)
+	}
+
+	c.startReading()
+
+	// idle fires when the connection might have exceeded the IdleTimeout.
+	var (
+		idle      *time.Timer
+		idleTimer <-chan time.Time
+	)
+
+	if s.IdleTimeout > 0 {
+		idle = time.NewTimer(s.IdleTimeout)
+		defer idle.Stop()
+
+		idleTimer = idle.C
+	}
+
+loop:
+	for {
+		select {
+		case fr := <-c.input:
+			c.takeFrame(fr)
+			s.dispatchFrame(c, fr)
+		case err := <-c.errch:
+			var stop bool
+			if closeErr, stop = s.connError(c, err); stop {
+				break loop
+			}
+		case <-c.Context().Done():
+			closeErr = closeContextDone(c, c.Context())
+			break loop
+		case <-s.shutdown:
+			closeErr = s.closeShutdown(c)
+			break loop
+		case <-idleTimer:
+			// the timer is rearmed with the remaining time
+			// if a frame was read or written in the meantime.
+			if d := c.idleFor(); d < s.IdleTimeout {
+				idle.Reset(s.IdleTimeout - d)
+				continue
+			}
+
+			closeErr = closeIdle(c)
+			break loop
+		case <-c.closer:
+			closeErr = writeError(c)
+			break loop
+		}
+	}
+
+	return closeErr
+}
+
+// readConn reads and handles the frames of c in the calling goroutine
+// until the connection is closed, see Server.ReadBufferFrames.
+//
+// The context, the shutdown and the IdleTimeout are watched using
+// callbacks, so no goroutine waits for them. They close the connection,
+// and the read is unblocked by the peer's close frame or by the
+// read deadline set by the write loop once the connection is closed.
+func (s *Server) readConn(c *Conn) (closeErr error) {
+	// interrupted is the close error of the first callback closing c.
+	var (
+		once        sync.Once
+		interrupted error
+	)
+
+	interrupt := func(closeConn func(c *Conn) error) {
+		once.Do(func() {
+			interrupted = closeConn(c)
+		})
+	}
+
+	// the context replaced by the handlers is watched instead
+	watchContext := func(ctx context.Context) func() bool {
+		return context.AfterFunc(ctx, func() {
+			interrupt(func(c *Conn) error {
+				return closeContextDone(c, ctx)
+			})
+		})
+	}
+
+	ctx := c.Context()
+	stopContext := watchContext(ctx)
+	defer func() {
+		stopContext()
+	}()
+
+	defer context.AfterFunc(s.shutdownCtx, func() {
+		interrupt(s.closeShutdown)
+	})()
+
+	if s.IdleTimeout > 0 {
+		// idleMu guards idle, which is used by its own callback,
+		// and stopped, set once readConn returns so the callback
+		// running meanwhile doesn't rearm the timer.
+		var (
+			idleMu  sync.Mutex
+			idle    *time.Timer
+			stopped bool
+		)
+
+		idleMu.Lock()
+		idle = time.AfterFunc(s.IdleTimeout, func() {
+			idleMu.Lock()
+			defer idleMu.Unlock()
+
+			if stopped {
+				return
+			}
+
+			// the timer is rearmed with the remaining time
+			// if a frame was read or written in the meantime.
+			if d := c.idleFor(); d < s.IdleTimeout {
+				idle.Reset(s.IdleTimeout - d)
+				return
+			}
+
+			interrupt(closeIdle)
+		})
+		idleMu.Unlock()
+
+		defer func() {
+			idleMu.Lock()
+			stopped = true
+			idle.Stop()
+			idleMu.Unlock()
+		}()
+	}
+
+	stop := false
+	for !stop && !c.isClosed() {
+		fr, err := c.readFrame()
+		if err != nil {
+			if !c.isClosed() {
+				closeErr = abnormalClosure(err)
+			}
+
+			break
+		}
+
+		s.dispatchFrame(c, fr)
+
+		if c.Context() != ctx {
+			stopContext()
+
+			ctx = c.Context()
+			stopContext = watchContext(ctx)
+		}
+
+		// the errors reported by the handlers and the write loop
+		for drained := false; !stop && !drained; {
+			select {
+			case err := <-c.errch:
+				closeErr, stop = s.connError(c, err)
+			default:
+				drained = true
+			}
+		}
+	}
+
+	if !stop && closeErr == nil {
+		closeErr = writeError(c)
+	}
+
+	// waits for a callback closing c, so interrupted can be read
+	once.Do(func() {})
+
+	if interrupted != nil {
+		closeErr = interrupted
+	}
+
+	return closeErr
+}
+
+// connError handles err, reported by the loops or the handlers of c.
+//
+// It returns the close error and whether c stops being served.
+// The errors that don't close the connection go to the ErrorHandler.
+func (s *Server) connError(c *Conn, err error) (closeErr error, stop bool) {
+	if err == nil {
+		return nil, true
+	}
+
+	if ce, ok := err.(closeError); ok {
+		return abnormalClosure(ce.err), true
+	}
+
+	if ce, ok := err.(Error); ok {
+		return ce, true
+	}
+
+	if s.errHandler != nil {
+		s.errHandler(c, err)
+	}
+
+	return nil, false
+}
+
+// writeError returns the close error of c if the write loop
+// failed before the connection was closed.
+func writeError(c *Conn) error {
+	// the write loop reports the error before aborting
+	select {
+	case err := <-c.errch:
+		if ce, ok := err.(closeError); ok {
+			return abnormalClosure(ce.err)
+		}
+	default:
+	}
+
+	return nil
+}
+
+// closeContextDone closes c with StatusGoAway once ctx, its context, is done.
+func closeContextDone(c *Conn, ctx context.Context) error {
+	err := ctx.Err()
+
+	c.CloseDetail(StatusGoAway, "")
+
+	return Error{
+		Status: StatusGoAway,
+		Reason: err.Error(),
+		err:    err,
+	}
+}
+
+// closeShutdown closes c with the status passed to Shutdown.
+func (s *Server) closeShutdown(c *Conn) error {
+	c.CloseDetail(s.shutdownStatus, s.shutdownReason)
+
+	return Error{
+		Status: s.shutdownStatus,
+		Reason: s.shutdownReason,
+		err:    ErrServerClosed,
+	}
+}
+
+// closeIdle closes c with StatusGoAway once the IdleTimeout is exceeded.
+func closeIdle(c *Conn) error {
+	c.CloseDetail(StatusGoAway, ErrIdleTimeout.Error())
+
+	return Error{
+		Status: StatusGoAway,
+		Reason: ErrIdleTimeout.Error(),
+		err:    ErrIdleTimeout,
+	}
+}
+
+func (s *Server) callCloseHandler(c *Conn, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			s.recoverPanic(c, v)
+		}
+	}()
+
+	s.closeHandler(c, err)
+}
+
+// recoverPanic reports the panic v recovered from a handler of c and closes c.
+func (s *Server) recoverPanic(c *Conn, v interface{}) error {
+	stack := debug.Stack()
+
+	if s.panicHandler != nil {
+		s.panicHandler(c, v, stack)
+	} else {
+		c.logf("websocket: panic: %v\n%s", v, stack)
+
+		if s.errHandler != nil {
+			s.errHandler(c, fmt.Errorf("panic: %v", v))
+		}
+	}
+
+	c.CloseDetail(StatusUnexpected, "")
+
+	return Error{
+		Status: StatusUnexpected,
+		Reason: fmt.Sprint(v),
+	}
+}
+
+// closeWriteTimeout is the time the server waits for the
+// pending frames to be written when closing a connection.
+const closeWriteTimeout = time.Second * 3
+
+// dispatchFrame passes fr, read from c, to the FrameMetaHandler and the FrameHandler.
+func (s *Server) dispatchFrame(c *Conn, fr *Frame) {
+	if s.frMetaHandler != nil {
+		s.frMetaHandler(c, uint8(fr.Code()), fr.Len(), fr.IsFin(), fr.IsMasked(), (fr.op[0]>>4)&7)
+	}
+
+	s.frHandler(c, fr)
+}
+
+func (s *Server) handleFrame(c *Conn, fr *Frame) {
+	// TODO: error if not masked
+	//
+	// An all-zero mask key is still a valid mask,
+	// only the mask bit must be checked.
+	if fr.IsMasked() {
+		fr.Unmask()
+	}
+
+	if fr.IsControl() {
+		s.handleControl(c, fr)
+	} else {
+		s.handleFrameData(c, fr)
+	}
+}
+
+func (s *Server) handleFrameData(c *Conn, fr *Frame) {
+	c.fragments++
+	if c.MaxFragments > 0 && c.fragments > c.MaxFragments {
+		// the frames received until the connection is closed are dropped too
+		c.CloseDetail(StatusPolicyViolation, errTooManyFragments.Error())
+		ReleaseFrame(fr)
+
+		return
+	}
+
+	if fr.IsFin() {
+		c.fragments = 0
+	}
+
+	// the frames are decompressed one by one, so the rest
+	// of the frame is handled as if it was never compressed.
+	if c.legacyDeflate && fr.HasRSV1() {
+		if err := c.inflateFrame(fr); err != nil {
+			var status StatusCode = StatusNotConsistent
+			if err == errLenTooBig {
+				status = StatusTooBig
+			}
+
+			c.CloseDetail(status, err.Error())
+			ReleaseFrame(fr)
+
+			return
+		}
+	}
+
+	// the message being delivered to a MessageStream
+	if c.reader != nil {
+		s.handleFrameReader(c, fr, nil)
+		return
+	}
+
+	if c.buffered == nil && !fr.IsContinuation() {
+		if sr := c.takeStream(); sr != nil {
+			c.readingStream = sr
+			s.handleFrameReader(c, fr, sr.handle)
+
+			return
+		}
+	}
+
+	msgs := c.messagesChan()
+
+	if s.readHandler != nil && msgs == nil {
+		s.handleFrameReader(c, fr, s.readHandler)
+		return
+	}
+
+	var data []byte
+
+	isBinary := fr.IsBinary()
+	// only the first frame of a message carries RSV1
+	compressed := c.compress && fr.HasRSV1()
+
+	// control frames can be received between the fragments of a message,
+	// but they are handled by handleControl, so the buffered message is kept.
+	bf := c.buffered
+	if bf == nil {
+		if fr.IsFin() {
+			data = fr.Payload()
+		} else {
+			bf = bytebufferpool.Get()
+			bf.Reset()
+
+			c.buffered = bf
+			c.bufferedBinary = isBinary
+			c.bufferedCompressed = compressed
+			bf.Write(fr.Payload())
+
+			atomic.StoreInt64(&c.pendingRead, int64(len(bf.B)))
+		}
+	} else {
+		// the continuation frames don't carry the message type
+		isBinary = c.bufferedBinary
+		compressed = c.bufferedCompressed
+
+		bf.Write(fr.Payload())
+		if fr.IsFin() {
+			data = bf.B
+			c.buffered = nil
+			defer bytebufferpool.Put(bf)
+
+			atomic.StoreInt64(&c.pendingRead, 0)
+		} else {
+			atomic.StoreInt64(&c.pendingRead, int64(len(bf.B)))
+		}
+	}
+
+	if compressed && len(data) != 0 {
+		dbf := bytebufferpool.Get()
+		defer bytebufferpool.Put(dbf)
+
+		dbf.Reset()
+
+		if err := decompressPayload(dbf, data, c.maxPayloadSize()); err != nil {
+			var status StatusCode = StatusNotConsistent
+			if err == errLenTooBig {
+				status = StatusTooBig
+			}
+
+			c.CloseDetail(status, err.Error())
+			ReleaseFrame(fr)
+
+			return
+		}
+
+		data = dbf.B
+	}
+
+	if len(data) != 0 {
+		switch {
+		case msgs != nil:
+			c.sendMessage(msgs, isBinary, data)
+		case !isBinary && s.textHandler != nil:
+			s.textHandler(c, data)
+		case isBinary && s.binaryHandler != nil:
+			s.binaryHandler(c, data)
+		case s.msgHandler != nil:
+			s.msgHandler(c, isBinary, data)
+		}
+	}
+
+	ReleaseFrame(fr)
+}
+
+// handleFrameReader streams the message to handler as the frames are received.
+//
+// handler is only used by the first frame of the message.
+func (s *Server) handleFrameReader(c *Conn, fr *Frame, handler MessageReaderHandler) {
+	mr := c.reader
+	if mr != nil {
+		isFin := fr.IsFin()
+
+		mr.frames <- fr
+
+		if isFin {
+			<-mr.done
+			c.reader = nil
+		}
+
+		return
+	}
+
+	isBinary := fr.IsBinary()
+
+	mr = &messageReader{
+		fr: fr,
+		b:  fr.Payload(),
+	}
+
+	var (
+		r  io.Reader = mr
+		dr *deflateReader
+	)
+
+	if c.compress && fr.HasRSV1() {
+		dr = newDeflateReader(mr, nil)
+		r = dr
+	}
+
+	// the whole message is in a single frame
+	if fr.IsFin() {
+		handler(c, isBinary, r)
+		mr.discard()
+
+		if dr != nil {
+			dr.Close()
+		}
+
+		return
+	}
+
+	mr.frames = make(chan *Frame)
+	mr.done = make(chan struct{})
+
+	c.reader = mr
+
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				s.recoverPanic(c, v)
+			}
+
+			mr.discard()
+
+			if dr != nil {
+				dr.Close()
+			}
+
+			close(mr.done)
+		}()
+
+		handler(c, isBinary, r)
+	}()
+}
+
+// messageReader streams the payload of a message
+// as the frames are received.
+type messageReader struct {
+	// frames receives the continuation frames.
+	frames chan *Frame
+	// done is closed when the handler has consumed the message.
+	done chan struct{}
+
+	fr  *Frame
+	b   []byte
+	err error
+}
+
+func (mr *messageReader) Read(p []byte) (int, error) {
+	for len(mr.b) == 0 {
+		if mr.err != nil {
+			return 0, mr.err
+		}
+
+		isFin := mr.fr.IsFin()
+
+		ReleaseFrame(mr.fr)
+		mr.fr = nil
+
+		if isFin {
+			mr.err = io.EOF
+			continue
+		}
+
+		fr, ok := <-mr.frames
+		if !ok {
+			mr.err = io.ErrUnexpectedEOF
+			continue
+		}
+
+		mr.fr = fr
+		mr.b = fr.Payload()
+	}
+
+	n := copy(p, mr.b)
+	mr.b = mr.b[n:]
+
+	return n, nil
+}
+
+// discard consumes the rest of the message.
+func (mr *messageReader) discard() {
+	for mr.err == nil {
+		mr.b = mr.b[:0]
+		mr.Read(nil)
+	}
+}
+
+func (s *Server) handleControl(c *Conn, fr *Frame) {
+	switch {
+	case fr.IsPing():
+		s.handlePing(c, fr.Payload())
+	case fr.IsPong():
+		s.handlePong(c, fr.Payload())
+	case fr.IsClose():
+		s.handleClose(c, fr)
+	}
+}
+
+func (s *Server) handlePing(c *Conn, data []byte) {
+	if s.pingHandler != nil {
+		s.pingHandler(c, data)
+	}
+
+	if s.DisableAutoPong {
+		return
+	}
+
+	pong := AcquireFrame()
+	pong.SetCode(CodePong)
 	pong.SetPayload(data)
 	pong.SetFin()
 
@@ -462,7 +1738,16 @@ func (s *Server) handlePong(c *Conn, data []byte) {
 }
 
 func (s *Server) handleClose(c *Conn, fr *Frame) {
+	select {
+	case <-c.closeReceived:
+		// the connection is already being closed
+		return
+	default:
+	}
+
 	defer c.closeOnce.Do(func() { close(c.closer) })
+	defer close(c.closeReceived)
+
 	c.errch <- func() error {
 		if fr.Status() != StatusNone {
 			return Error{
@@ -474,13 +1759,33 @@ func (s *Server) handleClose(c *Conn, fr *Frame) {
 		return nil
 	}()
 
-	status := fr.Status()
+	// the peer acknowledged the close frame sent by WriteClose
+	if atomic.LoadInt32(&c.closeSent) == 1 {
+		return
+	}
+
+	status, reason := fr.Status(), ""
+	if s.closeFrHandler != nil {
+		status, reason = s.closeFrHandler(c, status, fr.Payload())
+	}
+
+	// the reason must fit in a control frame along with the status,
+	// it's truncated without splitting a UTF-8 character.
+	if n := maxControlPayloadSize - 2; len(reason) > n {
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+
+		reason = reason[:n]
+	}
 
 	fr = AcquireFrame()
 	fr.SetClose()
 	fr.SetStatus(status)
 	fr.SetFin()
 
+	io.WriteString(fr, reason)
+
 	// reply back
 	c.WriteFrame(fr)
 }
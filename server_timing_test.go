@@ -2,6 +2,7 @@ package websocket
 
 import (
 	"context"
+	"crypto/rand"
 	"io"
 	"net"
 	"net/http"
@@ -141,7 +142,7 @@ func newFakeListener(requestsCount, clientsCount, requestsPerConn int, request [
 }
 
 func buildUpgrade() (s []byte) {
-	key := makeRandKey(nil)
+	key, _ := makeRandKey(nil, rand.Reader)
 	s = append(s, "GET / HTPP/1.1\r\n"+
 		"Host: localhost:8080\r\n"+
 		"Connection: Upgrade\r\n"+
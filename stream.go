@@ -0,0 +1,287 @@
+package websocket
+
+import (
+	"io"
+	"sync"
+)
+
+// MessageStream returns a stream over a single message in each direction.
+//
+// The data written into the stream is sent as one message, each Write
+// being a frame of it, that is completed when the stream is closed.
+// Other messages must not be written until then, otherwise their frames
+// are interleaved with the stream's ones. Control frames can be written anyway.
+//
+// Reading from the stream returns the payload of the next message received,
+// which isn't delivered to the Server handlers, and io.EOF once it is complete.
+// The messages received after it are delivered to the handlers as usual.
+// Like the MessageReaderHandler, no more frames are handled until the message
+// is read or the stream is closed, so the stream must not be read from the
+// handlers. Closing the stream discards the unread part of the message.
+//
+// The reads are safe to run concurrently with the writes,
+// but Write and Close must not be called concurrently.
+func (c *Conn) MessageStream(isBinary bool) io.ReadWriteCloser {
+	return &messageStream{
+		streamReader: c.newStreamReader(false),
+		c:            c,
+		isBinary:     isBinary,
+	}
+}
+
+// WriteTo implements io.WriterTo.
+//
+// WriteTo writes the payloads of the messages received into w until the
+// connection is closed, so they aren't delivered to the Server handlers.
+// No more frames are handled while w is being written, and WriteTo must
+// not be called from the handlers.
+//
+// If writing into w fails, the message being written is discarded and
+// the next ones are delivered to the handlers again.
+func (c *Conn) WriteTo(w io.Writer) (int64, error) {
+	sr := c.newStreamReader(true)
+
+	n, err := io.Copy(w, sr.pr)
+	if err != nil {
+		c.streamMu.Lock()
+		if c.stream == sr {
+			c.stream = nil
+		}
+		c.streamMu.Unlock()
+
+		sr.pr.CloseWithError(err)
+	}
+
+	return n, err
+}
+
+// Message is a message received from the connection.
+type Message struct {
+	IsBinary bool
+	Data     []byte
+}
+
+// Messages returns a channel receiving the messages read from the connection,
+// so they can be consumed selecting on other events too.
+//
+// Once Messages is called the messages are sent to the channel instead of
+// being delivered to the Server handlers, the control frames are handled as usual.
+// The channel buffers as many messages as frames the connection reads ahead
+// (see Server.ReadBufferFrames); when it is full, the connection is not read
+// until a message is received. The channel is closed when the connection is closed.
+//
+// Data is owned by the receiver, so it can be retained.
+func (c *Conn) Messages() <-chan Message {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+
+	if c.messages == nil {
+		c.messages = make(chan Message, cap(c.input))
+		if c.messagesClosed {
+			close(c.messages)
+		}
+	}
+
+	return c.messages
+}
+
+// messagesChan returns the channel returned by Messages, if any.
+func (c *Conn) messagesChan() chan Message {
+	c.streamMu.Lock()
+	ch := c.messages
+	c.streamMu.Unlock()
+
+	return ch
+}
+
+// sendMessage sends a copy of data to ch, unless the connection is closed.
+func (c *Conn) sendMessage(ch chan Message, isBinary bool, data []byte) {
+	m := Message{
+		IsBinary: isBinary,
+		Data:     append([]byte(nil), data...),
+	}
+
+	select {
+	case ch <- m:
+	case <-c.closer:
+	}
+}
+
+// closeMessages closes the channel returned by Messages
+// once the connection is closed.
+func (c *Conn) closeMessages() {
+	c.streamMu.Lock()
+	if c.messages != nil && !c.messagesClosed {
+		close(c.messages)
+	}
+	c.messagesClosed = true
+	c.streamMu.Unlock()
+}
+
+// newStreamReader registers a streamReader receiving the next message.
+//
+// A persistent streamReader receives all the messages
+// and returns io.EOF once the connection is closed.
+func (c *Conn) newStreamReader(persistent bool) *streamReader {
+	pr, pw := io.Pipe()
+
+	sr := &streamReader{
+		persistent: persistent,
+		pr:         pr,
+		pw:         pw,
+	}
+
+	c.streamMu.Lock()
+	if c.isClosed() {
+		sr.connClosed()
+	} else {
+		c.stream = sr
+	}
+	c.streamMu.Unlock()
+
+	return sr
+}
+
+// takeStream returns the streamReader waiting for a message, if any.
+//
+// Only the persistent streamReader is kept for the next message.
+func (c *Conn) takeStream() *streamReader {
+	c.streamMu.Lock()
+	sr := c.stream
+	if sr != nil && !sr.persistent {
+		c.stream = nil
+	}
+	c.streamMu.Unlock()
+
+	return sr
+}
+
+// dropStream unregisters the streamReader waiting for a message
+// once the connection is closed.
+func (c *Conn) dropStream() {
+	c.streamMu.Lock()
+	sr := c.stream
+	c.stream = nil
+	c.streamMu.Unlock()
+
+	if sr != nil {
+		sr.connClosed()
+	}
+}
+
+// streamReader receives the messages read from the connection
+// instead of the Server handlers.
+type streamReader struct {
+	persistent bool
+
+	// the payload of the messages received is copied from pw to pr.
+	pr *io.PipeReader
+	pw *io.PipeWriter
+}
+
+// handle is the MessageReaderHandler of the messages delivered to the stream.
+func (sr *streamReader) handle(c *Conn, isBinary bool, r io.Reader) {
+	_, err := io.Copy(sr.pw, r)
+	if err != nil || !sr.persistent {
+		sr.pw.CloseWithError(err)
+	}
+}
+
+// abort makes the stream's reads return err, unblocking handle.
+func (sr *streamReader) abort(err error) {
+	sr.pw.CloseWithError(err)
+}
+
+// connClosed ends the stream because the connection was closed.
+func (sr *streamReader) connClosed() {
+	if sr.persistent {
+		sr.pw.Close()
+	} else {
+		sr.pw.CloseWithError(ErrConnClosed)
+	}
+}
+
+type messageStream struct {
+	*streamReader
+
+	c        *Conn
+	isBinary bool
+	// wrote is whether the first frame of the message was written.
+	wrote bool
+	// closed is whether Close was called.
+	closed bool
+
+	closeOnce sync.Once
+}
+
+func (ms *messageStream) Read(p []byte) (int, error) {
+	return ms.pr.Read(p)
+}
+
+func (ms *messageStream) Write(p []byte) (int, error) {
+	if ms.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	fr := AcquireFrame()
+
+	switch {
+	case ms.wrote:
+		fr.SetContinuation()
+	case ms.isBinary:
+		fr.SetBinary()
+	default:
+		fr.SetText()
+	}
+
+	ms.wrote = true
+
+	fr.SetPayload(p)
+
+	if !ms.queue(fr) {
+		return 0, ErrConnClosed
+	}
+
+	return len(p), nil
+}
+
+// Close completes the message written and stops reading.
+func (ms *messageStream) Close() (err error) {
+	ms.closeOnce.Do(func() {
+		c := ms.c
+		ms.closed = true
+
+		c.streamMu.Lock()
+		if c.stream == ms.streamReader {
+			c.stream = nil
+		}
+		c.streamMu.Unlock()
+
+		ms.pr.CloseWithError(io.ErrClosedPipe)
+
+		fr := AcquireFrame()
+		fr.SetFin()
+
+		switch {
+		case ms.wrote:
+			fr.SetContinuation()
+		case ms.isBinary:
+			fr.SetBinary()
+		default:
+			fr.SetText()
+		}
+
+		if !ms.queue(fr) {
+			err = ErrConnClosed
+		}
+	})
+
+	return err
+}
+
+func (ms *messageStream) queue(fr *Frame) bool {
+	ms.c.wmu.Lock()
+	defer ms.c.wmu.Unlock()
+
+	return ms.c.queue(fr)
+}
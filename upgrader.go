@@ -1,10 +1,13 @@
 package websocket
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/sha1"
 	b64 "encoding/base64"
 	"github.com/valyala/fasthttp"
 	"hash"
+	"net"
 	"net/http"
 	"sync"
 )
@@ -15,11 +18,64 @@ type (
 	// UpgradeHandler is a middleware callback that determines whether the
 	// WebSocket connection should be upgraded or not. If UpgradeHandler returns false,
 	// the connection is not upgraded.
+	//
+	// When rejecting the upgrade, the handler can write the response, i.e. using
+	// ctx.Error. If it doesn't set a status, 403 Forbidden is sent.
 	UpgradeHandler func(*fasthttp.RequestCtx) bool
 	// UpgradeNetHandler is like UpgradeHandler but for net/http.
+	//
+	// When rejecting the upgrade, the handler can write the response.
+	// If it doesn't write anything, 403 Forbidden is sent.
 	UpgradeNetHandler func(resp http.ResponseWriter, req *http.Request) bool
 )
 
+// rejectWriter records whether the UpgradeNetHandler wrote the response.
+type rejectWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *rejectWriter) WriteHeader(status int) {
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *rejectWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher. Flushing writes the response headers.
+func (w *rejectWriter) Flush() {
+	w.wrote = true
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, so the handler can take over the connection
+// to write the response. It returns http.ErrNotSupported if the wrapped
+// writer can't be hijacked.
+func (w *rejectWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	c, brw, err := h.Hijack()
+	if err == nil {
+		w.wrote = true
+	}
+
+	return c, brw, err
+}
+
+// Unwrap allows using http.ResponseController.
+func (w *rejectWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func prepareOrigin(b []byte, uri *fasthttp.URI) []byte {
 	b = append(b[:0], uri.Scheme()...)
 	b = append(b, "://"...)
@@ -34,6 +90,21 @@ var shaPool = sync.Pool{
 
 var base64 = b64.StdEncoding
 
+// isValidKey reports whether key is a base64-encoded 16-byte value,
+// as required for the Sec-WebSocket-Key.
+//
+// https://tools.ietf.org/html/rfc6455#section-4.1
+func isValidKey(key []byte) bool {
+	if len(key) != base64.EncodedLen(16) {
+		return false
+	}
+
+	var b [18]byte
+	n, err := base64.Decode(b[:], key)
+
+	return err == nil && n == 16
+}
+
 func makeKey(dst, key []byte) []byte {
 	h := shaPool.Get().(hash.Hash)
 	h.Reset()
@@ -64,17 +135,44 @@ func appendDecode(enc *b64.Encoding, dst, src []byte) ([]byte, error) {
 	return b[:len(dst)+n], err
 }
 
+// headerProtocol returns the subprotocol set in h by the UpgradeHandler.
+//
+// The key is compared ignoring the case, since the normalizing is disabled.
+func headerProtocol(h *fasthttp.ResponseHeader) (proto string) {
+	h.VisitAll(func(k, v []byte) {
+		if equalsFold(k, wsHeaderProtocol) {
+			proto = string(v)
+		}
+	})
+
+	return proto
+}
+
 func selectProtocol(protos [][]byte, accepted []string) string {
 	if len(protos) == 0 {
 		return ""
 	}
 
+	if proto := matchProtocol(protos, accepted); proto != "" {
+		return proto
+	}
+
+	return string(bytes.TrimSpace(protos[0]))
+}
+
+// matchProtocol returns the first protocol in protos that is accepted,
+// or an empty string if none of them match.
+func matchProtocol(protos [][]byte, accepted []string) string {
 	for _, proto := range protos {
+		// the protocols are usually separated by ", "
+		proto = bytes.TrimSpace(proto)
+
 		for _, accept := range accepted {
 			if b2s(proto) == accept {
 				return accept
 			}
 		}
 	}
-	return string(protos[0])
+
+	return ""
 }
@@ -1,8 +1,19 @@
 package websocket
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
 )
 
 var (
@@ -55,3 +66,935 @@ func BenchmarkBase64Decoding(b *testing.B) {
 		}
 	}
 }
+
+func TestSelectProtocol(t *testing.T) {
+	protos := bytes.Split([]byte("chat, superchat"), commaString)
+
+	if proto := selectProtocol(protos, []string{"superchat"}); proto != "superchat" {
+		t.Fatalf("Expecting superchat, got %s", proto)
+	}
+
+	if proto := selectProtocol(protos, []string{"other"}); proto != "chat" {
+		t.Fatalf("Expecting chat, got %s", proto)
+	}
+
+	if proto := matchProtocol(protos, []string{"other"}); proto != "" {
+		t.Fatalf("Expecting no protocol, got %s", proto)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	s := &Server{}
+
+	if !s.checkOrigin([]byte("http://example.com")) {
+		t.Fatal("Expecting any origin to be allowed")
+	}
+
+	s.Origin = "http://example.com"
+	if s.checkOrigin([]byte("http://other.com")) {
+		t.Fatal("Expecting http://other.com to be rejected")
+	}
+
+	s.CheckOrigin = func(origin []byte) bool {
+		return bytes.HasSuffix(origin, []byte(".example.com"))
+	}
+
+	if !s.checkOrigin([]byte("https://staging.example.com")) {
+		t.Fatal("Expecting https://staging.example.com to be allowed")
+	}
+
+	if s.checkOrigin([]byte("http://example.com")) {
+		t.Fatal("Expecting CheckOrigin to override Origin")
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Origin", "http://other.com")
+
+	resp := httptest.NewRecorder()
+	s.NetUpgrade(resp, req)
+
+	if resp.Code != http.StatusForbidden {
+		t.Fatalf("Expecting status %d, got %d", http.StatusForbidden, resp.Code)
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("GET")
+	ctx.Request.Header.Set("Origin", "http://other.com")
+
+	s.Upgrade(ctx)
+
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusForbidden {
+		t.Fatalf("Expecting status %d, got %d", fasthttp.StatusForbidden, code)
+	}
+}
+
+func TestUpgradeHandlerHeaders(t *testing.T) {
+	s := &Server{
+		Protocols: []string{"a", "b"},
+		UpgradeHandler: func(ctx *fasthttp.RequestCtx) bool {
+			ctx.Response.Header.Set("Set-Cookie", "session=1")
+			ctx.Response.Header.Set("Sec-WebSocket-Protocol", "b")
+			return true
+		},
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("GET")
+	ctx.Request.Header.Set("Connection", "Upgrade")
+	ctx.Request.Header.Set("Upgrade", "websocket")
+	ctx.Request.Header.Set("Sec-WebSocket-Version", "13")
+	ctx.Request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	ctx.Request.Header.Set("Sec-WebSocket-Protocol", "a, b")
+
+	s.Upgrade(ctx)
+
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusSwitchingProtocols {
+		t.Fatalf("Expecting status %d, got %d", fasthttp.StatusSwitchingProtocols, code)
+	}
+
+	if cookie := string(ctx.Response.Header.Peek("Set-Cookie")); cookie != "session=1" {
+		t.Fatalf("Expecting session=1, got %q", cookie)
+	}
+
+	var protos []string
+	ctx.Response.Header.VisitAll(func(k, v []byte) {
+		if equalsFold(k, wsHeaderProtocol) {
+			protos = append(protos, string(v))
+		}
+	})
+
+	if len(protos) != 1 || protos[0] != "b" {
+		t.Fatalf("Expecting the protocol b, got %q", protos)
+	}
+}
+
+func TestUpgradeNetHandlerHeaders(t *testing.T) {
+	ws := &Server{
+		Protocols: []string{"a", "b"},
+		UpgradeNetHandler: func(resp http.ResponseWriter, req *http.Request) bool {
+			resp.Header().Set("Set-Cookie", "session=1")
+			resp.Header().Set("Sec-WebSocket-Protocol", "b")
+			return true
+		},
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(ws.NetUpgrade))
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Protocol", "a, b")
+
+	if err := req.Write(c); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expecting status %d, got %d", http.StatusSwitchingProtocols, res.StatusCode)
+	}
+
+	if cookie := res.Header.Get("Set-Cookie"); cookie != "session=1" {
+		t.Fatalf("Expecting session=1, got %q", cookie)
+	}
+
+	if protos := res.Header.Values("Sec-WebSocket-Protocol"); len(protos) != 1 || protos[0] != "b" {
+		t.Fatalf("Expecting the protocol b, got %q", protos)
+	}
+}
+
+func TestReadHandshake(t *testing.T) {
+	s := &Server{
+		Protocols: []string{"chat"},
+	}
+
+	headers := map[string]string{
+		"Connection":             "keep-alive, upgrade",
+		"Upgrade":                "websocket",
+		"Sec-WebSocket-Version":  "13",
+		"Sec-WebSocket-Key":      "dGhlIHNhbXBsZSBub25jZQ==",
+		"Sec-WebSocket-Protocol": "superchat, chat",
+	}
+
+	peek := func(key []byte) []byte {
+		for k, v := range headers {
+			if strings.EqualFold(k, string(key)) {
+				return []byte(v)
+			}
+		}
+
+		return nil
+	}
+
+	hs, status, _ := s.readHandshake([]byte("GET"), peek)
+	if status != 0 || hs.key == nil {
+		t.Fatalf("Expecting a valid handshake, got status %d", status)
+	}
+
+	if proto := selectProtocol(hs.protos, s.Protocols); proto != "chat" {
+		t.Fatalf("Expecting chat, got %q", proto)
+	}
+
+	if _, status, _ = s.readHandshake([]byte("POST"), peek); status != fasthttp.StatusBadRequest {
+		t.Fatalf("Expecting status %d, got %d", fasthttp.StatusBadRequest, status)
+	}
+
+	for _, key := range []string{
+		"",
+		"dGhlIHNhbXBsZQ==",
+		"dGhlIHNhbXBsZSBub25jZQ",
+		"dGhlIHNhbXBsZSBub25j!!==",
+		"dGhlIHNhbXBsZSBub25jZSBub25jZQ==",
+	} {
+		headers["Sec-WebSocket-Key"] = key
+		if _, status, _ = s.readHandshake([]byte("GET"), peek); status != fasthttp.StatusBadRequest {
+			t.Fatalf("%q: expecting status %d, got %d", key, fasthttp.StatusBadRequest, status)
+		}
+	}
+
+	headers["Sec-WebSocket-Key"] = "dGhlIHNhbXBsZSBub25jZQ=="
+
+	headers["Sec-WebSocket-Version"] = "8"
+	if _, status, _ = s.readHandshake([]byte("GET"), peek); status != fasthttp.StatusBadRequest {
+		t.Fatalf("Expecting status %d, got %d", fasthttp.StatusBadRequest, status)
+	}
+
+	headers["Connection"] = "keep-alive"
+	if hs, status, _ = s.readHandshake([]byte("GET"), peek); status != 0 || hs.key != nil {
+		t.Fatal("Expecting the request not to be an upgrade")
+	}
+}
+
+func TestNetUpgradeContext(t *testing.T) {
+	ws := &Server{}
+
+	values := make(chan interface{}, 1)
+	ws.HandleOpen(func(c *Conn) {
+		values <- c.UserValue("user")
+		c.Close()
+	})
+
+	s := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), "user", "gopher")
+		ws.NetUpgrade(resp, req.WithContext(ctx))
+	}))
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn, err := MakeClient(c, s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case v := <-values:
+		if v != "gopher" {
+			t.Fatalf("Expecting gopher, got %v", v)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	conn.c.Close()
+}
+
+func TestOnNetUpgrade(t *testing.T) {
+	ws := &Server{
+		OnNetUpgrade: func(req *http.Request) context.Context {
+			return context.WithValue(req.Context(), "user", req.Header.Get("X-User"))
+		},
+	}
+
+	values := make(chan interface{}, 1)
+	ws.HandleOpen(func(c *Conn) {
+		values <- c.UserValue("user")
+		c.Close()
+	})
+
+	s := httptest.NewServer(http.HandlerFunc(ws.NetUpgrade))
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.Set("X-User", "gopher")
+
+	conn, err := ClientWithHeaders(c, s.URL, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case v := <-values:
+		if v != "gopher" {
+			t.Fatalf("Expecting gopher, got %v", v)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	conn.c.Close()
+}
+
+// streamResponse is the response of an HTTP/2 stream written into a pipe.
+type streamResponse struct {
+	h      http.Header
+	status chan int
+	w      *io.PipeWriter
+}
+
+func (sr *streamResponse) Header() http.Header {
+	return sr.h
+}
+
+func (sr *streamResponse) WriteHeader(status int) {
+	sr.status <- status
+}
+
+func (sr *streamResponse) Write(b []byte) (int, error) {
+	return sr.w.Write(b)
+}
+
+func (sr *streamResponse) Flush() {}
+
+func TestNetUpgradeHTTP2(t *testing.T) {
+	ws := &Server{
+		Protocols: []string{"chat"},
+	}
+
+	ws.HandleData(func(c *Conn, isBinary bool, data []byte) {
+		c.Write(data)
+	})
+
+	closeCh := make(chan error, 1)
+	ws.HandleClose(func(c *Conn, err error) {
+		closeCh <- err
+	})
+
+	// the stream of the extended CONNECT request
+	reqBody, reqWriter := io.Pipe()
+	resBody, resWriter := io.Pipe()
+
+	req := httptest.NewRequest(http.MethodConnect, "https://localhost/", reqBody)
+	req.ProtoMajor = 2
+	req.Header.Set(":protocol", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", "chat")
+
+	res := &streamResponse{
+		h:      make(http.Header),
+		status: make(chan int, 1),
+		w:      resWriter,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ws.NetUpgrade(res, req)
+		close(done)
+	}()
+
+	if status := <-res.status; status != http.StatusOK {
+		t.Fatalf("Expecting status 200, got %d", status)
+	}
+
+	if proto := res.h.Get("Sec-WebSocket-Protocol"); proto != "chat" {
+		t.Fatalf("Expecting chat, got %q", proto)
+	}
+
+	fr := AcquireFrame()
+	defer ReleaseFrame(fr)
+
+	fr.SetText()
+	fr.SetFin()
+	fr.SetPayload([]byte("Hello"))
+	fr.Mask()
+
+	if _, err := fr.WriteTo(reqWriter); err != nil {
+		t.Fatal(err)
+	}
+
+	fr.Reset()
+	if _, err := fr.ReadFrom(resBody); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(fr.Payload()); s != "Hello" {
+		t.Fatalf("Expecting Hello, got %q", s)
+	}
+
+	fr.Reset()
+	fr.SetClose()
+	fr.SetFin()
+	fr.SetStatus(StatusNone)
+	fr.Mask()
+
+	if _, err := fr.WriteTo(reqWriter); err != nil {
+		t.Fatal(err)
+	}
+
+	// the close frame is echoed
+	fr.Reset()
+	if _, err := fr.ReadFrom(resBody); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fr.IsClose() {
+		t.Fatalf("Expecting a close frame, got %s", fr)
+	}
+
+	select {
+	case err := <-closeCh:
+		if err != nil {
+			t.Fatalf("Expecting a clean close, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestReadConnectHandshake(t *testing.T) {
+	s := &Server{}
+
+	headers := map[string]string{
+		":protocol":             "websocket",
+		"Sec-WebSocket-Version": "13",
+	}
+
+	peek := func(key []byte) []byte {
+		return []byte(headers[string(key)])
+	}
+
+	hs, status, _ := s.readConnectHandshake(peek)
+	if status != 0 || !hs.isUpgrade() || hs.key != nil {
+		t.Fatalf("Expecting a valid handshake, got status %d", status)
+	}
+
+	headers[":protocol"] = "connect-udp"
+	if hs, status, _ = s.readConnectHandshake(peek); status != 0 || hs.isUpgrade() {
+		t.Fatal("Expecting the request not to be an upgrade")
+	}
+
+	headers[":protocol"] = "websocket"
+	headers["Sec-WebSocket-Version"] = "8"
+	if _, status, _ = s.readConnectHandshake(peek); status != fasthttp.StatusBadRequest {
+		t.Fatalf("Expecting status %d, got %d", fasthttp.StatusBadRequest, status)
+	}
+}
+
+func TestRetainHeaders(t *testing.T) {
+	ws := Server{
+		RetainHeaders: []string{"User-Agent", "X-Session"},
+	}
+
+	headers := make(chan [3]string, 1)
+	ws.HandleOpen(func(c *Conn) {
+		headers <- [3]string{
+			c.RequestHeader("user-agent"),
+			c.RequestHeader("X-Session"),
+			c.RequestHeader("X-Other"),
+		}
+	})
+
+	ln := serveInmemory(t, &ws)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.Set("User-Agent", "test-agent")
+	req.Header.Set("X-Session", "42")
+	req.Header.Set("X-Other", "dropped")
+
+	conn, err := ClientWithHeaders(c, "http://localhost/", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case h := <-headers:
+		if h != [3]string{"test-agent", "42", ""} {
+			t.Fatalf("Unexpected headers %q", h)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+func TestConnPath(t *testing.T) {
+	type request struct {
+		path string
+		args map[string][]string
+	}
+
+	requests := make(chan request, 1)
+
+	ws := Server{}
+	ws.HandleOpen(func(c *Conn) {
+		requests <- request{c.Path(), c.QueryArgs()}
+	})
+
+	check := func(c net.Conn, url string) {
+		conn, err := MakeClient(c, url+"/ws/chat?room=go&tag=a&tag=b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		select {
+		case r := <-requests:
+			if r.path != "/ws/chat" {
+				t.Fatalf("Expecting /ws/chat, got %q", r.path)
+			}
+
+			expected := map[string][]string{
+				"room": {"go"},
+				"tag":  {"a", "b"},
+			}
+			if !reflect.DeepEqual(r.args, expected) {
+				t.Fatalf("Expecting %v, got %v", expected, r.args)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+	}
+
+	ln := serveInmemory(t, &ws)
+
+	c, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(c, "http://localhost")
+
+	s := httptest.NewServer(http.HandlerFunc(ws.NetUpgrade))
+	defer s.Close()
+
+	c, err = net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(c, s.URL)
+}
+
+func TestUpgradeReject(t *testing.T) {
+	newCtx := func() *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("GET")
+		ctx.Request.Header.Set("Connection", "Upgrade")
+		ctx.Request.Header.Set("Upgrade", "websocket")
+		ctx.Request.Header.Set("Sec-WebSocket-Version", "13")
+		ctx.Request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+		return ctx
+	}
+
+	for _, tc := range []struct {
+		handler func(ctx *fasthttp.RequestCtx) bool
+		status  int
+		body    string
+	}{
+		{func(ctx *fasthttp.RequestCtx) bool { return false }, fasthttp.StatusForbidden, ""},
+		{func(ctx *fasthttp.RequestCtx) bool {
+			ctx.Error("login first", fasthttp.StatusUnauthorized)
+			return false
+		}, fasthttp.StatusUnauthorized, "login first"},
+	} {
+		s := &Server{
+			UpgradeHandler: tc.handler,
+		}
+
+		ctx := newCtx()
+		s.Upgrade(ctx)
+
+		if code := ctx.Response.StatusCode(); code != tc.status {
+			t.Fatalf("Expecting status %d, got %d", tc.status, code)
+		}
+
+		if body := string(ctx.Response.Body()); body != tc.body {
+			t.Fatalf("Expecting %q, got %q", tc.body, body)
+		}
+
+		// the connection isn't upgraded
+		if len(ctx.Response.Header.PeekBytes(wsHeaderAccept)) != 0 || ctx.Hijacked() {
+			t.Fatal("Expecting the upgrade to be rejected")
+		}
+	}
+
+	for _, tc := range []struct {
+		handler func(resp http.ResponseWriter, req *http.Request) bool
+		status  int
+		body    string
+	}{
+		{func(resp http.ResponseWriter, req *http.Request) bool { return false }, http.StatusForbidden, ""},
+		{func(resp http.ResponseWriter, req *http.Request) bool {
+			http.Error(resp, "login first", http.StatusUnauthorized)
+			return false
+		}, http.StatusUnauthorized, "login first\n"},
+		{func(resp http.ResponseWriter, req *http.Request) bool {
+			// flushing writes 200 OK implicitly
+			if f, ok := resp.(http.Flusher); ok {
+				f.Flush()
+			}
+			return false
+		}, http.StatusOK, ""},
+	} {
+		s := &Server{
+			UpgradeNetHandler: tc.handler,
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+		resp := httptest.NewRecorder()
+		s.NetUpgrade(resp, req)
+
+		if resp.Code != tc.status {
+			t.Fatalf("Expecting status %d, got %d", tc.status, resp.Code)
+		}
+
+		if body := resp.Body.String(); body != tc.body {
+			t.Fatalf("Expecting %q, got %q", tc.body, body)
+		}
+
+		if resp.Header().Get("Sec-WebSocket-Accept") != "" {
+			t.Fatal("Expecting the upgrade to be rejected")
+		}
+	}
+}
+
+func TestUpgradeRejectHijack(t *testing.T) {
+	ws := &Server{
+		UpgradeNetHandler: func(resp http.ResponseWriter, req *http.Request) bool {
+			h, ok := resp.(http.Hijacker)
+			if !ok {
+				return false
+			}
+
+			c, _, err := h.Hijack()
+			if err != nil {
+				return false
+			}
+			defer c.Close()
+
+			io.WriteString(c, "HTTP/1.1 409 Conflict\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+
+			return false
+		},
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(ws.NetUpgrade))
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("Expecting status %d, got %d", http.StatusConflict, res.StatusCode)
+	}
+}
+
+func TestUpgradeProtocolLines(t *testing.T) {
+	s := &Server{
+		Protocols: []string{"b"},
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("GET")
+	ctx.Request.Header.Set("Connection", "Upgrade")
+	ctx.Request.Header.Set("Upgrade", "websocket")
+	ctx.Request.Header.Set("Sec-WebSocket-Version", "13")
+	ctx.Request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	ctx.Request.Header.Add("Sec-WebSocket-Protocol", "a")
+	ctx.Request.Header.Add("Sec-WebSocket-Protocol", "b")
+
+	s.Upgrade(ctx)
+
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusSwitchingProtocols {
+		t.Fatalf("Expecting status %d, got %d", fasthttp.StatusSwitchingProtocols, code)
+	}
+
+	if proto := string(ctx.Response.Header.PeekBytes(wsHeaderProtocol)); proto != "b" {
+		t.Fatalf("Expecting the protocol b, got %q", proto)
+	}
+
+	peek := peekAll(&ctx.Request.Header)
+	if v := string(peek(wsHeaderProtocol)); v != "a, b" {
+		t.Fatalf("Expecting %q, got %q", "a, b", v)
+	}
+
+	if v := string(peek(wsHeaderVersion)); v != "13" {
+		t.Fatalf("Expecting 13, got %q", v)
+	}
+}
+
+func TestHandshakeExtensions(t *testing.T) {
+	for _, tc := range []struct {
+		compress bool
+		legacy   bool
+		offer    string
+		expect   string
+	}{
+		{false, false, "", ""},
+		{false, false, "permessage-deflate", ""},
+		{true, false, "", ""},
+		{true, false, "x-webkit-deflate-frame", ""},
+		{true, false, "permessage-deflate; server_max_window_bits=10", ""},
+		{true, false, "permessage-deflate; client_max_window_bits",
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		{false, true, "x-webkit-deflate-frame", "x-webkit-deflate-frame; no_context_takeover"},
+		{true, true, "x-webkit-deflate-frame, permessage-deflate",
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+	} {
+		ws := &Server{
+			EnableCompression:   tc.compress,
+			EnableLegacyDeflate: tc.legacy,
+			// the extensions set by the handlers are replaced
+			UpgradeHandler: func(ctx *fasthttp.RequestCtx) bool {
+				ctx.Response.Header.Set("Sec-WebSocket-Extensions", "bogus")
+				return true
+			},
+			UpgradeNetHandler: func(resp http.ResponseWriter, req *http.Request) bool {
+				resp.Header().Set("Sec-WebSocket-Extensions", "bogus")
+				return true
+			},
+		}
+
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("GET")
+		ctx.Request.Header.Set("Connection", "Upgrade")
+		ctx.Request.Header.Set("Upgrade", "websocket")
+		ctx.Request.Header.Set("Sec-WebSocket-Version", "13")
+		ctx.Request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		if tc.offer != "" {
+			ctx.Request.Header.Set("Sec-WebSocket-Extensions", tc.offer)
+		}
+
+		ws.Upgrade(ctx)
+
+		var exts []string
+		ctx.Response.Header.VisitAll(func(k, v []byte) {
+			if equalsFold(k, wsHeaderExtensions) {
+				exts = append(exts, string(v))
+			}
+		})
+
+		if tc.expect == "" {
+			if len(exts) != 0 {
+				t.Fatalf("%q: expecting no extensions, got %q", tc.offer, exts)
+			}
+		} else if len(exts) != 1 || exts[0] != tc.expect {
+			t.Fatalf("%q: expecting %q, got %q", tc.offer, tc.expect, exts)
+		}
+
+		s := httptest.NewServer(http.HandlerFunc(ws.NetUpgrade))
+
+		c, err := net.Dial("tcp", s.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, _ := http.NewRequest("GET", s.URL, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		if tc.offer != "" {
+			req.Header.Set("Sec-WebSocket-Extensions", tc.offer)
+		}
+
+		if err := req.Write(c); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.ReadResponse(bufio.NewReader(c), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exts = res.Header.Values("Sec-WebSocket-Extensions")
+		if tc.expect == "" {
+			if len(exts) != 0 {
+				t.Fatalf("%q: expecting no extensions, got %q", tc.offer, exts)
+			}
+		} else if len(exts) != 1 || exts[0] != tc.expect {
+			t.Fatalf("%q: expecting %q, got %q", tc.offer, tc.expect, exts)
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestRequireHeaders(t *testing.T) {
+	s := &Server{
+		RequireHeaders: map[string]string{
+			"X-Api-Key": "1234",
+			"X-Client":  "",
+		},
+	}
+
+	for _, tc := range []struct {
+		headers  map[string]string
+		upgraded bool
+	}{
+		{map[string]string{"X-Api-Key": "1234", "X-Client": "test"}, true},
+		{map[string]string{"X-Api-Key": "123", "X-Client": "test"}, false},
+		{map[string]string{"X-Api-Key": "1234"}, false},
+		{map[string]string{"X-Client": "test"}, false},
+	} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("GET")
+		ctx.Request.Header.Set("Connection", "Upgrade")
+		ctx.Request.Header.Set("Upgrade", "websocket")
+		ctx.Request.Header.Set("Sec-WebSocket-Version", "13")
+		ctx.Request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+		for k, v := range tc.headers {
+			ctx.Request.Header.Set(k, v)
+			req.Header.Set(k, v)
+		}
+
+		s.Upgrade(ctx)
+
+		if ctx.Hijacked() != tc.upgraded {
+			t.Fatalf("%v: expecting upgraded %v, got status %d", tc.headers, tc.upgraded, ctx.Response.StatusCode())
+		}
+
+		if !tc.upgraded && ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+			t.Fatalf("%v: expecting status 403, got %d", tc.headers, ctx.Response.StatusCode())
+		}
+
+		// the recorder can't be hijacked, so the accepted upgrades fail later
+		resp := httptest.NewRecorder()
+		s.NetUpgrade(resp, req)
+
+		if (resp.Code == http.StatusForbidden) == tc.upgraded {
+			t.Fatalf("%v: expecting upgraded %v, got status %d", tc.headers, tc.upgraded, resp.Code)
+		}
+	}
+}
+
+func TestRequireNegotiation(t *testing.T) {
+	s := &Server{
+		Protocols:            []string{"chat"},
+		RequireProtocolMatch: true,
+		EnableCompression:    true,
+		RequireCompression:   true,
+	}
+
+	for _, tc := range []struct {
+		protocol   string
+		extensions string
+		upgraded   bool
+	}{
+		{"chat", "permessage-deflate", true},
+		{"other, chat", "permessage-deflate", true},
+		{"other", "permessage-deflate", false},
+		{"", "permessage-deflate", false},
+		{"chat", "", false},
+		{"chat", "x-webkit-deflate-frame", false},
+	} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod("GET")
+		ctx.Request.Header.Set("Connection", "Upgrade")
+		ctx.Request.Header.Set("Upgrade", "websocket")
+		ctx.Request.Header.Set("Sec-WebSocket-Version", "13")
+		ctx.Request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+		if tc.protocol != "" {
+			ctx.Request.Header.Set("Sec-WebSocket-Protocol", tc.protocol)
+			req.Header.Set("Sec-WebSocket-Protocol", tc.protocol)
+		}
+
+		if tc.extensions != "" {
+			ctx.Request.Header.Set("Sec-WebSocket-Extensions", tc.extensions)
+			req.Header.Set("Sec-WebSocket-Extensions", tc.extensions)
+		}
+
+		s.Upgrade(ctx)
+
+		if ctx.Hijacked() != tc.upgraded {
+			t.Fatalf("%q %q: expecting upgraded %v, got status %d",
+				tc.protocol, tc.extensions, tc.upgraded, ctx.Response.StatusCode())
+		}
+
+		if !tc.upgraded && ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+			t.Fatalf("%q %q: expecting status 400, got %d",
+				tc.protocol, tc.extensions, ctx.Response.StatusCode())
+		}
+
+		// the recorder can't be hijacked, so the accepted upgrades fail later
+		resp := httptest.NewRecorder()
+		s.NetUpgrade(resp, req)
+
+		if (resp.Code == http.StatusBadRequest) == tc.upgraded {
+			t.Fatalf("%q %q: expecting upgraded %v, got status %d",
+				tc.protocol, tc.extensions, tc.upgraded, resp.Code)
+		}
+	}
+}
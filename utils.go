@@ -1,6 +1,7 @@
 package websocket
 
 import (
+	"bytes"
 	"reflect"
 	"unsafe"
 )
@@ -32,3 +33,14 @@ func equalsFold(b, s []byte) (equals bool) {
 
 	return
 }
+
+// hasToken reports whether the comma separated list of tokens b contains token.
+func hasToken(b, token []byte) bool {
+	for _, t := range bytes.Split(b, commaString) {
+		if equalsFold(bytes.TrimSpace(t), token) {
+			return true
+		}
+	}
+
+	return false
+}